@@ -0,0 +1,110 @@
+// Command apfsim simulates a queueset subjected to a synthetic
+// workload, and reports how each flow fared. For example:
+//
+//	apfsim -scenario scenario.yaml -seed 42
+//
+// Given a trace, it replays the recorded requests through the queueset
+// of the scenario instead, and writes what happened to each of them as
+// JSON lines:
+//
+//	apfsim -scenario scenario.yaml -trace trace.jsonl -through handler -results results.jsonl
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tkashem/apf/pkg/simulator"
+)
+
+func main() {
+	scenarioPath := flag.String("scenario", "", "path to the YAML or JSON scenario to simulate")
+	seed := flag.Int64("seed", 0, "seed of the random number generators, overrides the seed of the scenario")
+	output := flag.String("output", "text", "format of the report, text or json")
+	tracePath := flag.String("trace", "", "path to a JSONL trace to replay through the queueset of the scenario, instead of its flows")
+	through := flag.String("through", "queueset", "what the trace is replayed through, queueset or handler")
+	resultsPath := flag.String("results", "", "path the JSONL results of the replay are written to, defaults to stdout")
+	flag.Parse()
+
+	var err error
+	if len(*tracePath) > 0 {
+		err = replay(*scenarioPath, *tracePath, *through, *resultsPath)
+	} else {
+		err = run(*scenarioPath, seed, *output)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apfsim: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(scenarioPath string, seed *int64, output string) error {
+	if len(scenarioPath) == 0 {
+		return fmt.Errorf("-scenario must be specified")
+	}
+	scenario, err := simulator.ReadScenario(scenarioPath)
+	if err != nil {
+		return err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			scenario.Seed = *seed
+		}
+	})
+
+	report, err := simulator.Run(scenario)
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "text":
+		return report.WriteText(os.Stdout)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return fmt.Errorf("unknown output format %q", output)
+}
+
+func replay(scenarioPath, tracePath, through, resultsPath string) error {
+	if len(scenarioPath) == 0 {
+		return fmt.Errorf("-scenario must be specified")
+	}
+	scenario, err := simulator.ReadScenario(scenarioPath)
+	if err != nil {
+		return err
+	}
+	trace, err := simulator.ReadTraceFile(tracePath)
+	if err != nil {
+		return err
+	}
+
+	var results []simulator.Result
+	switch through {
+	case "queueset":
+		results, err = simulator.ReplayQueueSet(&scenario.QueueSet, trace)
+	case "handler":
+		results, err = simulator.ReplayHandler(&scenario.QueueSet, trace)
+	default:
+		return fmt.Errorf("unknown replay target %q", through)
+	}
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(resultsPath) > 0 {
+		f, err := os.Create(resultsPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return simulator.WriteResults(w, results)
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+	"github.com/tkashem/apf/pkg/metrics"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+const example = `
+priorityLevels:
+- name: exempt
+  exempt: true
+- name: workload-high
+  totalSeats: 10
+  queues: 64
+  handSize: 6
+  queueLengthLimit: 50
+  lendablePercent: 50
+  maxQueueWait: 5s
+- name: catch-all
+  totalSeats: 5
+  queues: 16
+  handSize: 4
+  queueLengthLimit: 20
+  adaptiveLimit:
+    algorithm: AIMD
+    minSeats: 1
+    latencyThreshold: 500ms
+flows:
+- name: system
+  priorityLevel: exempt
+  rules:
+  - users: ["system:admin"]
+- name: writes
+  priorityLevel: workload-high
+  rules:
+  - pathPrefix: /api/
+    methods: ["POST", "PUT", "DELETE"]
+  distinguisher:
+    type: ByUser
+- name: catch-all
+  priorityLevel: catch-all
+  rules:
+  - pathPrefix: /
+  distinguisher:
+    type: ByHeader
+    header: X-Tenant
+costRules:
+- match:
+    pathPrefix: /api/list
+  cost:
+    seats: 10
+    duration: 2s
+defaultCost:
+  seats: 1
+  duration: 100ms
+exemptions:
+- pathPrefix: /healthz
+queueWaitTimeout: 15s
+rejectEarly: true
+`
+
+func TestParseAndBuild(t *testing.T) {
+	c, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	m := metrics.New()
+	events := map[string]queueset.Events{}
+	components, err := c.Build(Options{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		Events: func(priorityLevel string) queueset.Events {
+			events[priorityLevel] = m.QueueSetEvents(priorityLevel)
+			return events[priorityLevel]
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	if len(components.PriorityLevels) != 3 {
+		t.Fatalf("expected 3 priority levels, but got: %d", len(components.PriorityLevels))
+	}
+	if len(events) != 2 {
+		t.Errorf("expected the events of 2 queuesets, but got: %d", len(events))
+	}
+	for _, level := range components.PriorityLevels[1:] {
+		if got := level.QueueSet.Events; got == nil || got != events[level.Name] {
+			t.Errorf("expected priority level %q to have its own events, but got: %v", level.Name, got)
+		}
+	}
+	if qs := components.PriorityLevels[1].QueueSet; qs.TotalSeats != 10 || qs.QueuingConfig.NQueues != 64 || qs.QueueSelector == nil {
+		t.Errorf("unexpected queueset configuration: %+v", qs)
+	}
+	if qs := components.PriorityLevels[2].QueueSet; qs.Limiter == nil || qs.Limiter.Limit() != 5 {
+		t.Errorf("expected an adaptive limiter that starts at the total seats, but got: %+v", qs.Limiter)
+	}
+	if qs := components.PriorityLevels[1].QueueSet; qs.Limiter != nil {
+		t.Errorf("expected no adaptive limiter, but got: %+v", qs.Limiter)
+	}
+
+	newRequest := func(method, path, user, tenant string) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		if len(user) > 0 {
+			r.Header.Set("X-Remote-User", user)
+		}
+		if len(tenant) > 0 {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		return r
+	}
+
+	for _, test := range []struct {
+		request *http.Request
+		level   string
+		exempt  bool
+		seats   uint32
+		// wait is the queue wait timeout of the request
+		wait time.Duration
+	}{
+		{request: newRequest("GET", "/healthz", "", ""), level: "catch-all", exempt: true, seats: 1, wait: 15 * time.Second},
+		{request: newRequest("GET", "/api/pods", "system:admin", ""), level: "exempt", seats: 1, wait: 15 * time.Second},
+		{request: newRequest("POST", "/api/pods", "alice", ""), level: "workload-high", seats: 1, wait: 5 * time.Second},
+		{request: newRequest("GET", "/api/list", "alice", ""), level: "catch-all", seats: 10, wait: 15 * time.Second},
+	} {
+		r := test.request
+		if level, err := components.Classifier.Classify(r); err != nil || level != test.level {
+			t.Errorf("%s %s: expected priority level: %q, but got: %q, %v", r.Method, r.URL.Path, test.level, level, err)
+		}
+		if exempt, _ := components.Exempt.IsExempt(r); exempt != test.exempt {
+			t.Errorf("%s %s: expected exempt: %t, but got: %t", r.Method, r.URL.Path, test.exempt, exempt)
+		}
+		fr, err := components.Converter.Convert(r)
+		if err != nil {
+			t.Fatalf("%s %s: failed to convert: %v", r.Method, r.URL.Path, err)
+		}
+		if seats, _ := fr.EstimateCost(); seats != test.seats {
+			t.Errorf("%s %s: expected seats: %d, but got: %d", r.Method, r.URL.Path, test.seats, seats)
+		}
+		budget, ok := fr.(fairqueuing.WaitBudgeter).WaitBudget()
+		if !ok || budget > test.wait || budget < test.wait-time.Second {
+			t.Errorf("%s %s: expected a wait budget of %s, but got: %s, %t", r.Method, r.URL.Path, test.wait, budget, ok)
+		}
+	}
+
+	flowID := func(r *http.Request) uint64 {
+		fr, err := components.Converter.Convert(r)
+		if err != nil {
+			t.Fatalf("failed to convert: %v", err)
+		}
+		return uint64(fr.GetFlowID())
+	}
+	if flowID(newRequest("POST", "/api/a", "alice", "")) != flowID(newRequest("PUT", "/api/b", "alice", "")) {
+		t.Errorf("expected the requests of the same user to belong to the same flow")
+	}
+	if flowID(newRequest("POST", "/api/a", "alice", "")) == flowID(newRequest("POST", "/api/a", "bob", "")) {
+		t.Errorf("expected the requests of different users to belong to different flows")
+	}
+	if flowID(newRequest("GET", "/x", "", "red")) == flowID(newRequest("GET", "/x", "", "blue")) {
+		t.Errorf("expected the requests of different tenants to belong to different flows")
+	}
+
+	fr, err := components.Converter.Convert(newRequest("POST", "/api/a", "alice", ""))
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	classification := fr.(apfhttp.Classified).Classification()
+	if classification.PriorityLevel != "workload-high" || classification.Flow != "writes" || classification.FlowDistinguisher != "alice" {
+		t.Errorf("expected the request to be classified to flow writes of alice, but got: %+v", classification)
+	}
+	if uint64(classification.FlowHash) != uint64(fr.GetFlowID()) {
+		t.Errorf("expected the flow hash to be the flow ID: %d, but got: %d", fr.GetFlowID(), classification.FlowHash)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	_, err := Parse([]byte(`{
+		"priorityLevels": [{"name": "catch-all", "totalSeats": 1, "queues": 1, "handSize": 1, "queueLengthLimit": 1}],
+		"flows": [{"name": "catch-all", "priorityLevel": "catch-all", "rules": [{"pathPrefix": "/"}]}],
+		"defaultCost": {"seats": 1, "duration": "1s"}
+	}`))
+	if err != nil {
+		t.Errorf("expected no error, but got: %v", err)
+	}
+}
+
+func TestValidationErrorsNameTheField(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace [2]string
+		want    string
+	}{
+		{name: "hand size", replace: [2]string{"handSize: 6", "handSize: 65"}, want: "priorityLevels[1].handSize"},
+		{name: "queues", replace: [2]string{"queues: 64", "queues: 0"}, want: "priorityLevels[1].queues"},
+		{name: "duplicate level", replace: [2]string{"name: catch-all\n  totalSeats", "name: exempt\n  totalSeats"}, want: "priorityLevels[2].name"},
+		{name: "unknown level", replace: [2]string{"priorityLevel: workload-high", "priorityLevel: workload-low"}, want: "flows[1].priorityLevel"},
+		{name: "method", replace: [2]string{`"DELETE"`, `"delete"`}, want: "flows[1].rules[0].methods[2]"},
+		{name: "distinguisher", replace: [2]string{"type: ByUser", "type: ByGroup"}, want: "flows[1].distinguisher.type"},
+		{name: "cost", replace: [2]string{"seats: 10", "seats: 0"}, want: "costRules[0].cost.seats"},
+		{name: "path prefix", replace: [2]string{"pathPrefix: /healthz", "pathPrefix: healthz"}, want: "exemptions[0].pathPrefix"},
+		{name: "unknown field", replace: [2]string{"queueWaitTimeout:", "queueWaitLimit:"}, want: "queueWaitLimit"},
+		{name: "adaptive limit", replace: [2]string{"latencyThreshold: 500ms", "maxSeats: 6"}, want: "priorityLevels[2].adaptiveLimit.maxSeats"},
+		{name: "queue length limit", replace: [2]string{"queueLengthLimit: 50", "queueLengthLimit: -1"}, want: "priorityLevels[1].queueLengthLimit"},
+		{name: "backoff ratio", replace: [2]string{"latencyThreshold: 500ms", "latencyThreshold: 500ms\n    backoffRatio: 1"}, want: "priorityLevels[2].adaptiveLimit.backoffRatio"},
+		{name: "max queue wait", replace: [2]string{"maxQueueWait: 5s", "maxQueueWait: -5s"}, want: "priorityLevels[1].maxQueueWait"},
+		{name: "deadline fraction", replace: [2]string{"rejectEarly: true", "queueWaitDeadlineFraction: 2"}, want: "queueWaitDeadlineFraction"},
+		{name: "duration", replace: [2]string{"duration: 2s", "duration: 2"}, want: "duration"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := strings.Replace(example, test.replace[0], test.replace[1], 1)
+			if data == example {
+				t.Fatalf("the replacement did not change the configuration")
+			}
+			_, err := Parse([]byte(data))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected an error naming %q, but got: %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestValidationAcceptsWhatTheQueueSetAccepts(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace [2]string
+	}{
+		// the queueset rejects the requests it cannot execute immediately
+		{name: "no queuing", replace: [2]string{"queueLengthLimit: 50", "queueLengthLimit: 0"}},
+		{name: "default backoff ratio", replace: [2]string{"latencyThreshold: 500ms", "latencyThreshold: 500ms\n    backoffRatio: 0"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := strings.Replace(example, test.replace[0], test.replace[1], 1)
+			if data == example {
+				t.Fatalf("the replacement did not change the configuration")
+			}
+			c, err := Parse([]byte(data))
+			if err != nil {
+				t.Fatalf("expected no error, but got: %v", err)
+			}
+			if _, err := c.Build(Options{Clock: clocktesting.NewFakeClock(time.Now())}); err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildDefaultsTheClock(t *testing.T) {
+	c, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	components, err := c.Build(Options{})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	for _, level := range components.PriorityLevels[1:] {
+		if level.QueueSet.Clock == nil {
+			t.Errorf("expected priority level %q to have a clock", level.Name)
+		}
+	}
+	fr, err := components.Converter.Convert(httptest.NewRequest("POST", "/api/pods", nil))
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if budget, ok := fr.(fairqueuing.WaitBudgeter).WaitBudget(); !ok || budget <= 0 {
+		t.Errorf("expected a wait budget, but got: %s, %t", budget, ok)
+	}
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing/prioritylevel"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/yaml"
+)
+
+// Parse decodes the given YAML or JSON configuration, and validates it.
+// Unknown fields are rejected.
+func Parse(data []byte) (*Configuration, error) {
+	c := &Configuration{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadFile reads and parses the configuration in the given file
+func ReadFile(path string) (*Configuration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Options holds the dependencies of the components that are not
+// part of the configuration.
+type Options struct {
+	// Clock is the clock of the queuesets, the converter, and the
+	// watcher, it defaults to the real clock.
+	Clock clock.Clock
+	// Events, if specified, returns the Events of the queueset of the
+	// given priority level, like the QueueSetEvents of the metrics.
+	Events func(priorityLevel string) queueset.Events
+}
+
+// withDefaults returns the options, with the defaults of the ones
+// that are not specified.
+func (o Options) withDefaults() Options {
+	if o.Clock == nil {
+		o.Clock = clock.RealClock{}
+	}
+	return o
+}
+
+// Components holds the implementations built from a configuration,
+// they are meant to be wired into the http handler, and the
+// priority level controller.
+type Components struct {
+	Converter      apfhttp.Converter
+	Exempt         apfhttp.Exempt
+	Classifier     apfhttp.Classifier
+	PriorityLevels []prioritylevel.Config
+
+	// ContextTransformer, if not nil, is to be wired into the http
+	// handler, so each request is evaluated against one configuration
+	// from start to end.
+	ContextTransformer apfhttp.ContextTransformer
+}
+
+// Build turns a valid configuration into its components
+func (c *Configuration) Build(options Options) (*Components, error) {
+	options = options.withDefaults()
+	levels := make([]prioritylevel.Config, 0, len(c.PriorityLevels))
+	for i, level := range c.PriorityLevels {
+		if level.Exempt {
+			levels = append(levels, prioritylevel.Config{Name: level.Name, Exempt: true})
+			continue
+		}
+
+		selector, err := queueselector.NewShuffleShardingQueueSelector(level.Queues, level.HandSize)
+		if err != nil {
+			return nil, fmt.Errorf("priorityLevels[%d]: %w", i, err)
+		}
+		limiter, err := level.limiter()
+		if err != nil {
+			return nil, fmt.Errorf("priorityLevels[%d].adaptiveLimit: %w", i, err)
+		}
+		var events queueset.Events
+		if options.Events != nil {
+			events = options.Events(level.Name)
+		}
+		levels = append(levels, prioritylevel.Config{
+			Name: level.Name,
+			QueueSet: &queueset.Config{
+				TotalSeats: level.TotalSeats,
+				QueuingConfig: &queueset.QueuingConfig{
+					NQueues:        level.Queues,
+					HandSize:       level.HandSize,
+					QueueMaxLength: level.QueueLengthLimit,
+				},
+				QueueSelector: selector,
+				Clock:         options.Clock,
+				Events:        events,
+				Limiter:       limiter,
+			},
+			LendablePercent:       level.LendablePercent,
+			BorrowingLimitPercent: level.BorrowingLimitPercent,
+		})
+	}
+
+	rules := newRules(c)
+	return &Components{
+		Converter:      apfhttp.NewClassifyingConverter(options.Clock, rules.QueueWaitContext, rules.Classification, rules.Cost),
+		Exempt:         rules,
+		Classifier:     rules,
+		PriorityLevels: levels,
+	}, nil
+}
+
+// limiter returns the limiter of the priority level, if it has one
+func (level *PriorityLevel) limiter() (queueset.Limiter, error) {
+	limit := level.AdaptiveLimit
+	if limit == nil {
+		return nil, nil
+	}
+	bounds := queueset.LimiterBounds{Min: limit.MinSeats, Max: limit.maxSeats(level.TotalSeats)}
+	if limit.Algorithm == AdaptiveAIMD {
+		return queueset.NewAIMDLimiter(queueset.AIMDConfig{
+			LimiterBounds:    bounds,
+			LatencyThreshold: limit.LatencyThreshold.Duration,
+			BackoffRatio:     limit.BackoffRatio,
+		})
+	}
+	return queueset.NewGradientLimiter(queueset.GradientConfig{LimiterBounds: bounds, Tolerance: limit.Tolerance})
+}
+
+func (limit *AdaptiveLimit) maxSeats(totalSeats uint32) uint32 {
+	if limit.MaxSeats == 0 {
+		return totalSeats
+	}
+	return limit.MaxSeats
+}
+
+func newRules(c *Configuration) *rules {
+	r := &rules{config: c, userHeader: c.UserHeader}
+	if len(r.userHeader) == 0 {
+		r.userHeader = defaultUserHeader
+	}
+
+	maxWaits := map[string]time.Duration{}
+	for _, level := range c.PriorityLevels {
+		if level.MaxQueueWait.Duration > 0 {
+			maxWaits[level.Name] = level.MaxQueueWait.Duration
+		}
+	}
+	r.queueWait = apfhttp.MaxQueueWait(r, maxWaits, c.QueueWaitTimeout.Duration)
+	if c.QueueWaitDeadlineFraction > 0 {
+		r.queueWait = apfhttp.ShortestQueueWait(r.queueWait, apfhttp.QueueWaitFraction(c.QueueWaitDeadlineFraction))
+	}
+	if c.RejectEarly {
+		r.queueWait = apfhttp.RejectEarly(r.queueWait)
+	}
+	return r
+}
+
+// rules evaluates the flows, the cost rules and the exemptions of
+// a configuration against a request.
+type rules struct {
+	config     *Configuration
+	userHeader string
+	queueWait  apfhttp.QueueWaitContextFunc
+}
+
+func (r *rules) user(req *http.Request) string {
+	return req.Header.Get(r.userHeader)
+}
+
+func (r *rules) flow(req *http.Request) (*Flow, error) {
+	user := r.user(req)
+	for i := range r.config.Flows {
+		if flow := &r.config.Flows[i]; matchesAny(flow.Rules, req, user) {
+			return flow, nil
+		}
+	}
+	return nil, fmt.Errorf("no flow matches the request %s %q", req.Method, req.URL.Path)
+}
+
+func (r *rules) QueueWaitContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return r.queueWait(req)
+}
+
+func (r *rules) IsExempt(req *http.Request) (bool, error) {
+	return matchesAny(r.config.Exemptions, req, r.user(req)), nil
+}
+
+func (r *rules) Classify(req *http.Request) (string, error) {
+	flow, err := r.flow(req)
+	if err != nil {
+		return "", err
+	}
+	return flow.PriorityLevel, nil
+}
+
+func (r *rules) Classification(req *http.Request) (apfhttp.Classification, error) {
+	flow, err := r.flow(req)
+	if err != nil {
+		return apfhttp.Classification{}, err
+	}
+
+	var distinguisher string
+	switch flow.Distinguisher.Type {
+	case DistinguisherByUser:
+		distinguisher = r.user(req)
+	case DistinguisherByPath:
+		distinguisher = req.URL.Path
+	case DistinguisherByHeader:
+		distinguisher = req.Header.Get(flow.Distinguisher.Header)
+	}
+	computed := apfhttp.ComputeFlow(req, func(*http.Request) []string {
+		if flow.Distinguisher.Type == DistinguisherNone {
+			return []string{flow.Name}
+		}
+		return []string{flow.Name, distinguisher}
+	})
+	return apfhttp.Classification{
+		PriorityLevel:     flow.PriorityLevel,
+		Flow:              flow.Name,
+		FlowDistinguisher: distinguisher,
+		FlowHash:          computed.Hash,
+	}, nil
+}
+
+func (r *rules) Cost(req *http.Request) (uint32, time.Duration, error) {
+	user := r.user(req)
+	cost := r.config.DefaultCost
+	for i := range r.config.CostRules {
+		if rule := &r.config.CostRules[i]; rule.Match.matches(req, user) {
+			cost = rule.Cost
+			break
+		}
+	}
+	return cost.Seats, cost.Duration.Duration, nil
+}
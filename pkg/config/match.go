@@ -0,0 +1,46 @@
+package config
+
+import (
+	"net/http"
+	"strings"
+)
+
+const defaultUserHeader = "X-Remote-User"
+
+// matches returns true if all the specified fields of m match the request
+func (m *Match) matches(r *http.Request, user string) bool {
+	if len(m.PathPrefix) > 0 && !strings.HasPrefix(r.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if len(m.Methods) > 0 && !contains(m.Methods, r.Method) {
+		return false
+	}
+	for name, value := range m.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (len(value) > 0 && !contains(values, value)) {
+			return false
+		}
+	}
+	if len(m.Users) > 0 && !contains(m.Users, "*") && !contains(m.Users, user) {
+		return false
+	}
+	return true
+}
+
+func matchesAny(matches []Match, r *http.Request, user string) bool {
+	for i := range matches {
+		if matches[i].matches(r, user) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
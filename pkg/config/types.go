@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Configuration declares the priority levels, the flows, the cost
+// estimation rules and the exemptions of the fair queuing filter,
+// it can be written in YAML or JSON.
+type Configuration struct {
+	// PriorityLevels is the list of priority levels, their names
+	// must be unique.
+	PriorityLevels []PriorityLevel `json:"priorityLevels"`
+
+	// Flows are evaluated in the order they appear, the first one
+	// that matches a request decides its priority level and flow.
+	Flows []Flow `json:"flows"`
+
+	// CostRules are evaluated in the order they appear, the first
+	// one that matches a request decides its cost, if none matches
+	// DefaultCost is used.
+	CostRules   []CostRule `json:"costRules,omitempty"`
+	DefaultCost Cost       `json:"defaultCost"`
+
+	// Exemptions lists the requests that are not subject to fair
+	// queuing at all, a request is exempt if any of them matches.
+	Exemptions []Match `json:"exemptions,omitempty"`
+
+	// QueueWaitTimeout, if positive, is the maximum time a request
+	// may wait in queue, otherwise a request waits as long as its
+	// context allows.
+	QueueWaitTimeout Duration `json:"queueWaitTimeout,omitempty"`
+
+	// QueueWaitDeadlineFraction, if positive, is the fraction of the
+	// time left until the deadline of a request that it may wait in
+	// queue, the shorter of it and the queue wait timeout applies.
+	QueueWaitDeadlineFraction float64 `json:"queueWaitDeadlineFraction,omitempty"`
+
+	// RejectEarly, if true, rejects a request on arrival if it is
+	// expected to wait in queue for longer than it may.
+	RejectEarly bool `json:"rejectEarly,omitempty"`
+
+	// UserHeader is the request header that carries the name of the
+	// user, X-Remote-User if not specified.
+	UserHeader string `json:"userHeader,omitempty"`
+}
+
+type PriorityLevel struct {
+	Name string `json:"name"`
+
+	// Exempt, if true, the requests that belong to the priority level
+	// are executed immediately, the rest of the fields are ignored.
+	Exempt bool `json:"exempt,omitempty"`
+
+	TotalSeats uint32 `json:"totalSeats"`
+	Queues     int    `json:"queues"`
+	HandSize   int    `json:"handSize"`
+
+	// QueueLengthLimit, if 0, the requests are not queued, a request
+	// that cannot execute immediately is rejected.
+	QueueLengthLimit int `json:"queueLengthLimit"`
+
+	LendablePercent       int  `json:"lendablePercent,omitempty"`
+	BorrowingLimitPercent *int `json:"borrowingLimitPercent,omitempty"`
+
+	// MaxQueueWait, if positive, is the maximum time a request of the
+	// priority level may wait in queue, it overrides QueueWaitTimeout.
+	MaxQueueWait Duration `json:"maxQueueWait,omitempty"`
+
+	// AdaptiveLimit, if specified, adapts the number of seats of the
+	// priority level to the latency of its requests. The limiter
+	// starts over whenever the configuration is reloaded.
+	AdaptiveLimit *AdaptiveLimit `json:"adaptiveLimit,omitempty"`
+}
+
+type AdaptiveAlgorithm string
+
+const (
+	// AdaptiveAIMD backs off whenever a request takes longer than the
+	// latency threshold, and grows the limit a seat at a time otherwise
+	AdaptiveAIMD AdaptiveAlgorithm = "AIMD"
+
+	// AdaptiveGradient reduces the limit as the latency grows beyond
+	// its long term average
+	AdaptiveGradient AdaptiveAlgorithm = "Gradient"
+)
+
+// AdaptiveLimit keeps the number of seats of a priority level in the
+// range [minSeats, maxSeats], maxSeats defaults to the total seats of
+// the priority level.
+type AdaptiveLimit struct {
+	Algorithm AdaptiveAlgorithm `json:"algorithm"`
+	MinSeats  uint32            `json:"minSeats"`
+	MaxSeats  uint32            `json:"maxSeats,omitempty"`
+
+	// LatencyThreshold and BackoffRatio apply to AIMD, the threshold
+	// must be specified, the ratio defaults to 0.9 if it is 0.
+	LatencyThreshold Duration `json:"latencyThreshold,omitempty"`
+	BackoffRatio     float64  `json:"backoffRatio,omitempty"`
+
+	// Tolerance applies to Gradient
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
+// Flow assigns the requests that match any of its rules to a
+// priority level, the requests are further divided into flows by
+// the distinguisher.
+type Flow struct {
+	Name          string        `json:"name"`
+	PriorityLevel string        `json:"priorityLevel"`
+	Rules         []Match       `json:"rules"`
+	Distinguisher Distinguisher `json:"distinguisher,omitempty"`
+}
+
+// Match matches a request if all of the specified fields match.
+type Match struct {
+	// PathPrefix matches if the path of the request starts with it
+	PathPrefix string `json:"pathPrefix,omitempty"`
+
+	// Methods matches if the method of the request is one of them
+	Methods []string `json:"methods,omitempty"`
+
+	// Headers matches if the request has each of the headers with the
+	// given value, an empty value matches any value.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Users matches if the user of the request is one of them, "*"
+	// matches any user.
+	Users []string `json:"users,omitempty"`
+}
+
+type DistinguisherType string
+
+const (
+	// DistinguisherNone puts all the requests of a flow in one flow
+	DistinguisherNone DistinguisherType = ""
+
+	// DistinguisherByUser distinguishes the flows by the user
+	DistinguisherByUser DistinguisherType = "ByUser"
+
+	// DistinguisherByPath distinguishes the flows by the path
+	DistinguisherByPath DistinguisherType = "ByPath"
+
+	// DistinguisherByHeader distinguishes the flows by the value of
+	// the request header specified in Header
+	DistinguisherByHeader DistinguisherType = "ByHeader"
+)
+
+type Distinguisher struct {
+	Type   DistinguisherType `json:"type,omitempty"`
+	Header string            `json:"header,omitempty"`
+}
+
+// CostRule assigns a cost to the requests that match
+type CostRule struct {
+	Match Match `json:"match"`
+	Cost  Cost  `json:"cost"`
+}
+
+// Cost is the estimated cost of a request, the number of seats it
+// occupies for the given duration.
+type Cost struct {
+	Seats    uint32   `json:"seats"`
+	Duration Duration `json:"duration"`
+}
+
+// Duration is a time.Duration that is written as a string such as
+// "300ms" or "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
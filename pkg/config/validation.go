@@ -0,0 +1,169 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+)
+
+// Validate returns an error for each field of the configuration that is
+// invalid, the error names the offending field, as in
+// "priorityLevels[1].handSize".
+func (c *Configuration) Validate() error {
+	v := &validator{}
+
+	levels := map[string]bool{}
+	for i, level := range c.PriorityLevels {
+		path := fmt.Sprintf("priorityLevels[%d]", i)
+		switch {
+		case len(level.Name) == 0:
+			v.add(path+".name", "must not be empty")
+		case levels[level.Name]:
+			v.add(path+".name", "%q is specified more than once", level.Name)
+		}
+		levels[level.Name] = true
+		if level.Exempt {
+			continue
+		}
+
+		if level.TotalSeats < 1 {
+			v.add(path+".totalSeats", "must be positive")
+		}
+		if level.QueueLengthLimit < 0 {
+			v.add(path+".queueLengthLimit", "must not be negative")
+		}
+		// the hand size is only checked against a valid number of
+		// queues, so the error names the field that is wrong.
+		if level.Queues < 1 {
+			v.add(path+".queues", "must be positive")
+		} else if _, err := queueselector.NewDealer(level.Queues, level.HandSize); err != nil {
+			v.add(path+".handSize", "invalid for %d queues: %v", level.Queues, err)
+		}
+		if level.LendablePercent < 0 || level.LendablePercent > 100 {
+			v.add(path+".lendablePercent", "must be in the range [0, 100]")
+		}
+		if level.BorrowingLimitPercent != nil && *level.BorrowingLimitPercent < 0 {
+			v.add(path+".borrowingLimitPercent", "must not be negative")
+		}
+		if level.MaxQueueWait.Duration < 0 {
+			v.add(path+".maxQueueWait", "must not be negative")
+		}
+		if level.AdaptiveLimit != nil {
+			v.adaptiveLimit(path+".adaptiveLimit", level.AdaptiveLimit, level.TotalSeats)
+		}
+	}
+
+	flows := map[string]bool{}
+	for i, flow := range c.Flows {
+		path := fmt.Sprintf("flows[%d]", i)
+		switch {
+		case len(flow.Name) == 0:
+			v.add(path+".name", "must not be empty")
+		case flows[flow.Name]:
+			v.add(path+".name", "%q is specified more than once", flow.Name)
+		}
+		flows[flow.Name] = true
+
+		if !levels[flow.PriorityLevel] {
+			v.add(path+".priorityLevel", "%q is not a priority level", flow.PriorityLevel)
+		}
+		if len(flow.Rules) == 0 {
+			v.add(path+".rules", "must not be empty")
+		}
+		for j := range flow.Rules {
+			v.match(fmt.Sprintf("%s.rules[%d]", path, j), flow.Rules[j])
+		}
+
+		switch flow.Distinguisher.Type {
+		case DistinguisherNone, DistinguisherByUser, DistinguisherByPath:
+		case DistinguisherByHeader:
+			if len(flow.Distinguisher.Header) == 0 {
+				v.add(path+".distinguisher.header", "must not be empty")
+			}
+		default:
+			v.add(path+".distinguisher.type", "unknown type %q", flow.Distinguisher.Type)
+		}
+	}
+	if len(c.Flows) == 0 {
+		v.add("flows", "must not be empty")
+	}
+
+	for i := range c.CostRules {
+		path := fmt.Sprintf("costRules[%d]", i)
+		v.match(path+".match", c.CostRules[i].Match)
+		v.cost(path+".cost", c.CostRules[i].Cost)
+	}
+	v.cost("defaultCost", c.DefaultCost)
+
+	for i := range c.Exemptions {
+		v.match(fmt.Sprintf("exemptions[%d]", i), c.Exemptions[i])
+	}
+	if c.QueueWaitTimeout.Duration < 0 {
+		v.add("queueWaitTimeout", "must not be negative")
+	}
+	if f := c.QueueWaitDeadlineFraction; f < 0 || f > 1 {
+		v.add("queueWaitDeadlineFraction", "%v is not in the range [0, 1]", f)
+	}
+
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) match(path string, m Match) {
+	if len(m.PathPrefix) > 0 && !strings.HasPrefix(m.PathPrefix, "/") {
+		v.add(path+".pathPrefix", "must start with \"/\"")
+	}
+	for i, method := range m.Methods {
+		if len(method) == 0 || strings.ToUpper(method) != method {
+			v.add(fmt.Sprintf("%s.methods[%d]", path, i), "%q is not an upper case http method", method)
+		}
+	}
+	for name := range m.Headers {
+		if len(name) == 0 {
+			v.add(path+".headers", "header name must not be empty")
+		}
+	}
+}
+
+func (v *validator) adaptiveLimit(path string, limit *AdaptiveLimit, totalSeats uint32) {
+	switch limit.Algorithm {
+	case AdaptiveAIMD:
+		if limit.LatencyThreshold.Duration <= 0 {
+			v.add(path+".latencyThreshold", "must be positive")
+		}
+		if limit.BackoffRatio < 0 || limit.BackoffRatio >= 1 {
+			v.add(path+".backoffRatio", "must be in the range (0, 1), or 0 for the default")
+		}
+	case AdaptiveGradient:
+		if limit.Tolerance != 0 && limit.Tolerance < 1 {
+			v.add(path+".tolerance", "must be at least 1")
+		}
+	default:
+		v.add(path+".algorithm", "must be one of %q, %q", AdaptiveAIMD, AdaptiveGradient)
+	}
+
+	if limit.MinSeats < 1 {
+		v.add(path+".minSeats", "must be positive")
+	}
+	if seats := limit.maxSeats(totalSeats); seats < limit.MinSeats || seats > totalSeats {
+		v.add(path+".maxSeats", "must be in the range [minSeats, totalSeats]")
+	}
+}
+
+func (v *validator) cost(path string, cost Cost) {
+	if cost.Seats < 1 {
+		v.add(path+".seats", "must be positive")
+	}
+	if cost.Duration.Duration <= 0 {
+		v.add(path+".duration", "must be positive")
+	}
+}
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing/prioritylevel"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+)
+
+// ReloadEvents is notified of the outcome of each attempt to reload
+// a configuration file that has changed.
+type ReloadEvents interface {
+	Reloaded(path string)
+	ReloadFailed(path string, err error)
+}
+
+// PriorityLevelReconfigurer is implemented by the priority level
+// controller. Reconfigure is expected to leave the priority levels
+// unchanged if it fails, like the controller does, so the previous
+// configuration stays in effect.
+type PriorityLevelReconfigurer interface {
+	Reconfigure(...prioritylevel.Config) error
+}
+
+type WatcherOptions struct {
+	Options
+
+	// Period at which the file is checked for changes
+	Period time.Duration
+
+	ReloadEvents ReloadEvents
+}
+
+// NewWatcher reads the configuration in the given file, the file must
+// exist and the configuration in it must be valid.
+func NewWatcher(path string, options WatcherOptions) (*Watcher, error) {
+	if options.Period <= 0 {
+		return nil, fmt.Errorf("period must be positive")
+	}
+	options.Options = options.Options.withDefaults()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	built, err := c.Build(options.Options)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	w := &Watcher{path: path, options: options, applied: sha256.Sum256(data), levels: built.PriorityLevels}
+	w.rules.current.Store(newRules(c))
+	w.components = &Components{
+		Converter:          apfhttp.NewClassifyingConverter(options.Clock, w.rules.QueueWaitContext, w.rules.Classification, w.rules.Cost),
+		Exempt:             &w.rules,
+		Classifier:         &w.rules,
+		PriorityLevels:     built.PriorityLevels,
+		ContextTransformer: &w.rules,
+	}
+	return w, nil
+}
+
+// Watcher watches a configuration file, and applies the changes to a
+// running fair queuing filter. The flows, the cost rules and the
+// exemptions are swapped atomically, a request that is pinned by the
+// ContextTransformer is evaluated against the rules in effect when it
+// arrived. The priority levels are reconfigured in place. If the file
+// is not valid, the previous configuration stays in effect.
+type Watcher struct {
+	path       string
+	options    WatcherOptions
+	components *Components
+	rules      swappableRules
+
+	lock sync.Mutex
+	// applied is the checksum of the content of the file in effect,
+	// and invalid is that of the last content that is not a valid
+	// configuration, neither is attempted again. A content that could
+	// not be applied to the priority levels is attempted again on the
+	// next reload. lastReadErr is the last error reading the file.
+	applied, invalid [sha256.Size]byte
+	lastReadErr      string
+	// levels are the priority levels in effect
+	levels []prioritylevel.Config
+}
+
+// Components returns the components that are meant to be wired into
+// the http handler, and the priority level controller. The Converter,
+// Exempt and Classifier use the configuration currently in effect, or
+// the one the ContextTransformer pinned the request to, the
+// PriorityLevels are from the initial configuration.
+func (w *Watcher) Components() *Components {
+	return w.components
+}
+
+// Run checks the file for changes every period until the given
+// context is done, and reconfigures the given priority levels.
+func (w *Watcher) Run(ctx context.Context, levels PriorityLevelReconfigurer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.options.Clock.After(w.options.Period):
+			w.Reload(levels)
+		}
+	}
+}
+
+// Reload applies the configuration in the file if it has changed since
+// it was last applied, it returns true if it has been applied.
+func (w *Watcher) Reload(levels PriorityLevelReconfigurer) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		if err.Error() != w.lastReadErr {
+			w.lastReadErr = err.Error()
+			w.failed(err)
+		}
+		return false
+	}
+	w.lastReadErr = ""
+
+	checksum := sha256.Sum256(data)
+	if checksum == w.applied || checksum == w.invalid {
+		return false
+	}
+
+	c, err := Parse(data)
+	if err != nil {
+		w.invalid = checksum
+		w.failed(err)
+		return false
+	}
+	built, err := c.Build(w.options.Options)
+	if err != nil {
+		w.invalid = checksum
+		w.failed(err)
+		return false
+	}
+
+	// the new priority levels are added before the rules are swapped,
+	// so a new flow does not get to a priority level that does not
+	// exist yet, and the removed ones are kept until after the swap,
+	// so an old flow does not get to a priority level that no longer
+	// exists.
+	transition := keepRemovedLevels(built.PriorityLevels, w.levels)
+	if err := levels.Reconfigure(transition...); err != nil {
+		w.failed(err)
+		return false
+	}
+	w.levels = transition
+	w.rules.current.Store(newRules(c))
+	w.applied = [sha256.Size]byte{}
+	if len(transition) != len(built.PriorityLevels) {
+		// the new rules are in effect, the removal of the priority
+		// levels they no longer use is attempted again on the next
+		// reload, whatever the content of the file is by then.
+		if err := levels.Reconfigure(built.PriorityLevels...); err != nil {
+			w.failed(fmt.Errorf("failed to remove priority levels: %w", err))
+			return false
+		}
+	}
+	w.levels = built.PriorityLevels
+	w.applied = checksum
+	if w.options.ReloadEvents != nil {
+		w.options.ReloadEvents.Reloaded(w.path)
+	}
+	return true
+}
+
+// keepRemovedLevels returns the given priority levels, followed by the
+// old ones that are not among them.
+func keepRemovedLevels(levels, old []prioritylevel.Config) []prioritylevel.Config {
+	names := map[string]bool{}
+	for _, level := range levels {
+		names[level.Name] = true
+	}
+	kept := append([]prioritylevel.Config(nil), levels...)
+	for _, level := range old {
+		if !names[level.Name] {
+			kept = append(kept, level)
+		}
+	}
+	return kept
+}
+
+func (w *Watcher) failed(err error) {
+	if w.options.ReloadEvents != nil {
+		w.options.ReloadEvents.ReloadFailed(w.path, err)
+	}
+}
+
+// swappableRules evaluates a request against the rules currently in
+// effect, or the rules the request has been pinned to by Derive, so
+// all the evaluations of a request see the same configuration.
+type swappableRules struct {
+	current atomic.Pointer[rules]
+}
+
+type rulesKey struct{}
+
+// Derive pins the request to the rules currently in effect
+func (s *swappableRules) Derive(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithValue(r.Context(), rulesKey{}, s.current.Load()), func() {}
+}
+
+func (s *swappableRules) get(r *http.Request) *rules {
+	if pinned, ok := r.Context().Value(rulesKey{}).(*rules); ok {
+		return pinned
+	}
+	return s.current.Load()
+}
+
+func (s *swappableRules) QueueWaitContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return s.get(r).QueueWaitContext(r)
+}
+
+func (s *swappableRules) IsExempt(r *http.Request) (bool, error) {
+	return s.get(r).IsExempt(r)
+}
+
+func (s *swappableRules) Classify(r *http.Request) (string, error) {
+	return s.get(r).Classify(r)
+}
+
+func (s *swappableRules) Classification(r *http.Request) (apfhttp.Classification, error) {
+	return s.get(r).Classification(r)
+}
+
+func (s *swappableRules) Cost(r *http.Request) (uint32, time.Duration, error) {
+	return s.get(r).Cost(r)
+}
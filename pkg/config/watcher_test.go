@@ -0,0 +1,289 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/prioritylevel"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apf.yaml")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("failed to write the configuration: %v", err)
+		}
+	}
+	write(example)
+
+	events := &reloadEvents{}
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	w, err := NewWatcher(path, WatcherOptions{
+		Options:      Options{Clock: fakeClock},
+		Period:       time.Second,
+		ReloadEvents: events,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the watcher: %v", err)
+	}
+	components := w.Components()
+	levels, err := prioritylevel.NewController(components.PriorityLevels...)
+	if err != nil {
+		t.Fatalf("failed to create the priority levels: %v", err)
+	}
+
+	classify := func() string {
+		level, _ := components.Classifier.Classify(httptest.NewRequest("POST", "/api/pods", nil))
+		return level
+	}
+	totalSeats := func(name string) uint32 {
+		qs, ok := levels.Get(name)
+		if !ok {
+			return 0
+		}
+		return qs.(interface{ TotalSeats() uint32 }).TotalSeats()
+	}
+	if classify() != "workload-high" {
+		t.Fatalf("expected the write to be classified as workload-high, but got: %q", classify())
+	}
+
+	// nothing has changed
+	if w.Reload(levels) || len(events.get()) != 0 {
+		t.Errorf("expected no reload, but got events: %v", events.get())
+	}
+
+	// move the writes to catch-all, and grow catch-all
+	changed := strings.Replace(example, "priorityLevel: workload-high", "priorityLevel: catch-all", 1)
+	changed = strings.Replace(changed, "totalSeats: 5", "totalSeats: 7", 1)
+	write(changed)
+	if !w.Reload(levels) {
+		t.Fatalf("expected the configuration to be reloaded, events: %v", events.get())
+	}
+	if classify() != "catch-all" || totalSeats("catch-all") != 7 {
+		t.Errorf("expected the new configuration to be in effect, but got level: %q, seats: %d", classify(), totalSeats("catch-all"))
+	}
+
+	// a bad file leaves the previous configuration in effect, and
+	// is reported once
+	write(strings.Replace(changed, "handSize: 6", "handSize: 65", 1))
+	w.Reload(levels)
+	w.Reload(levels)
+	if classify() != "catch-all" || totalSeats("catch-all") != 7 {
+		t.Errorf("expected the previous configuration to stay in effect, but got level: %q, seats: %d", classify(), totalSeats("catch-all"))
+	}
+	if got := events.get(); len(got) != 2 || got[0] != "reloaded" || !strings.Contains(got[1], "priorityLevels[1].handSize") {
+		t.Errorf("unexpected events: %v", got)
+	}
+
+	// the watcher picks up a good file on its own
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx, levels)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	write(example)
+	deadline := time.Now().Add(30 * time.Second)
+	for classify() != "workload-high" {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the configuration to be reloaded, events: %v", events.get())
+		}
+		if fakeClock.HasWaiters() {
+			fakeClock.Step(time.Second)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if totalSeats("catch-all") != 5 {
+		t.Errorf("expected catch-all to go back to 5 seats, but got: %d", totalSeats("catch-all"))
+	}
+}
+
+func TestWatcherReloadIsAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apf.yaml")
+	if err := os.WriteFile(path, []byte(example), 0o644); err != nil {
+		t.Fatalf("failed to write the configuration: %v", err)
+	}
+	w, err := NewWatcher(path, WatcherOptions{
+		Options: Options{Clock: clocktesting.NewFakeClock(time.Now())},
+		Period:  time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the watcher: %v", err)
+	}
+	components := w.Components()
+	controller, err := prioritylevel.NewController(components.PriorityLevels...)
+	if err != nil {
+		t.Fatalf("failed to create the priority levels: %v", err)
+	}
+
+	// the request is pinned to the rules in effect when it arrives
+	pinned := httptest.NewRequest("POST", "/api/pods", nil)
+	ctx, cancel := components.ContextTransformer.Derive(pinned)
+	defer cancel()
+	pinned = pinned.WithContext(ctx)
+
+	// the writes move to a new priority level, and the one they were
+	// in is removed along with them.
+	levels := &checkingReconfigurer{t: t, controller: controller, classifier: components.Classifier}
+	if err := os.WriteFile(path, []byte(strings.ReplaceAll(example, "workload-high", "batch")), 0o644); err != nil {
+		t.Fatalf("failed to write the configuration: %v", err)
+	}
+	if !w.Reload(levels) {
+		t.Fatalf("expected the configuration to be reloaded")
+	}
+	if levels.calls == 0 {
+		t.Fatalf("expected the priority levels to be reconfigured")
+	}
+
+	for r, want := range map[*http.Request]string{
+		pinned: "workload-high",
+		httptest.NewRequest("POST", "/api/pods", nil): "batch",
+	} {
+		if level, err := components.Classifier.Classify(r); err != nil || level != want {
+			t.Errorf("expected the request to be classified as %q, but got: %q, %v", want, level, err)
+		}
+	}
+	if _, ok := controller.Get("workload-high"); ok {
+		t.Errorf("expected the priority level workload-high to be removed")
+	}
+}
+
+func TestWatcherRetriesAfterReconfigureFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apf.yaml")
+	if err := os.WriteFile(path, []byte(example), 0o644); err != nil {
+		t.Fatalf("failed to write the configuration: %v", err)
+	}
+	events := &reloadEvents{}
+	w, err := NewWatcher(path, WatcherOptions{
+		Options:      Options{Clock: clocktesting.NewFakeClock(time.Now())},
+		Period:       time.Second,
+		ReloadEvents: events,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the watcher: %v", err)
+	}
+	components := w.Components()
+	controller, err := prioritylevel.NewController(components.PriorityLevels...)
+	if err != nil {
+		t.Fatalf("failed to create the priority levels: %v", err)
+	}
+	classify := func() string {
+		level, _ := components.Classifier.Classify(httptest.NewRequest("POST", "/api/pods", nil))
+		return level
+	}
+
+	changed := strings.Replace(example, "priorityLevel: workload-high", "priorityLevel: catch-all", 1)
+	if err := os.WriteFile(path, []byte(changed), 0o644); err != nil {
+		t.Fatalf("failed to write the configuration: %v", err)
+	}
+
+	// the priority levels fail to be reconfigured, the previous
+	// configuration stays in effect.
+	levels := &failingReconfigurer{controller: controller, failures: 1}
+	if w.Reload(levels) {
+		t.Fatalf("expected the reload to fail")
+	}
+	if classify() != "workload-high" {
+		t.Errorf("expected the previous configuration to stay in effect, but got level: %q", classify())
+	}
+
+	// the same content is attempted again, even though the file has
+	// not changed since.
+	if !w.Reload(levels) {
+		t.Fatalf("expected the configuration to be reloaded, events: %v", events.get())
+	}
+	if classify() != "catch-all" {
+		t.Errorf("expected the new configuration to be in effect, but got level: %q", classify())
+	}
+	if w.Reload(levels) {
+		t.Errorf("expected no reload once the configuration is in effect")
+	}
+	if got := events.get(); len(got) != 2 || got[0] != "failed: transient" || got[1] != "reloaded" {
+		t.Errorf("unexpected events: %v", got)
+	}
+}
+
+// failingReconfigurer fails the given number of reconfigurations before
+// it passes them on to the controller.
+type failingReconfigurer struct {
+	controller PriorityLevelReconfigurer
+	failures   int
+}
+
+func (f *failingReconfigurer) Reconfigure(configs ...prioritylevel.Config) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("transient")
+	}
+	return f.controller.Reconfigure(configs...)
+}
+
+// checkingReconfigurer checks that the writes are routed to a priority
+// level that exists, before, and after each step of a reload.
+type checkingReconfigurer struct {
+	t          *testing.T
+	controller interface {
+		PriorityLevelReconfigurer
+		Get(string) (fairqueuing.FairQueueSet, bool)
+	}
+	classifier interface {
+		Classify(*http.Request) (string, error)
+	}
+	calls int
+}
+
+func (c *checkingReconfigurer) Reconfigure(configs ...prioritylevel.Config) error {
+	c.check()
+	defer c.check()
+	c.calls++
+	return c.controller.Reconfigure(configs...)
+}
+
+func (c *checkingReconfigurer) check() {
+	level, err := c.classifier.Classify(httptest.NewRequest("POST", "/api/pods", nil))
+	if err != nil {
+		c.t.Fatalf("failed to classify the request: %v", err)
+	}
+	if _, ok := c.controller.Get(level); !ok {
+		c.t.Errorf("the request is routed to the priority level %q that does not exist", level)
+	}
+}
+
+type reloadEvents struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (e *reloadEvents) Reloaded(string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.events = append(e.events, "reloaded")
+}
+
+func (e *reloadEvents) ReloadFailed(_ string, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.events = append(e.events, "failed: "+err.Error())
+}
+
+func (e *reloadEvents) get() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string(nil), e.events...)
+}
@@ -0,0 +1,219 @@
+package fairness
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+
+	"k8s.io/utils/clock"
+)
+
+// NewCollector returns a Collector, the clock must be the one the
+// latency trackers of the requests use.
+func NewCollector(clock clock.PassiveClock) *Collector {
+	return &Collector{
+		clock:    clock,
+		flows:    map[fairqueuing.FlowIDType]*FlowStats{},
+		requests: map[fairqueuing.Request]bool{},
+	}
+}
+
+// Collector implements the Events of a queueset, it keeps track of the
+// outcome of the requests of each flow, as told by the events and the
+// latency trackers of the requests.
+type Collector struct {
+	clock clock.PassiveClock
+
+	lock  sync.Mutex
+	flows map[fairqueuing.FlowIDType]*FlowStats
+	// requests holds the requests that have not been disposed of, or
+	// rejected yet, the value is true once the request is enqueued.
+	requests map[fairqueuing.Request]bool
+}
+
+// FlowStats tells how the requests of a flow fared
+type FlowStats struct {
+	Flow fairqueuing.FlowIDType
+
+	Arrived, Executed, Rejected int
+
+	// Waiting is the number of requests of the flow that are still
+	// waiting in queue.
+	Waiting int
+
+	// Demand is the estimated seat-seconds of the requests that
+	// arrived, and Served is the seats of the requests that executed,
+	// times their actual execution duration.
+	Demand, Served float64
+
+	// MaxQueueWait is the longest a request of the flow waited in
+	// queue, including the requests that are still waiting.
+	MaxQueueWait time.Duration
+}
+
+func (c *Collector) flow(r fairqueuing.Request) *FlowStats {
+	id := r.GetFlowID()
+	stats, ok := c.flows[id]
+	if !ok {
+		stats = &FlowStats{Flow: id}
+		c.flows[id] = stats
+	}
+	return stats
+}
+
+func (c *Collector) arrived(r fairqueuing.Request) {
+	stats := c.flow(r)
+	stats.Arrived++
+	_, width := r.EstimateCost()
+	stats.Demand += width.ToFloat()
+}
+
+// queueWait returns how long the given enqueued request has waited
+func (c *Collector) queueWait(r fairqueuing.Request) time.Duration {
+	startedAt, _ := r.LatencyTrackers().QueueWait.Get()
+	return c.clock.Since(startedAt)
+}
+
+func (c *Collector) observeWait(r fairqueuing.Request) {
+	stats := c.flow(r)
+	stats.Waiting--
+	if wait := c.queueWait(r); wait > stats.MaxQueueWait {
+		stats.MaxQueueWait = wait
+	}
+}
+
+func (c *Collector) QueueSelected(_ fairqueuing.FairQueue, r fairqueuing.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.requests[r] = false
+	c.arrived(r)
+}
+
+func (c *Collector) Enqueued(_ fairqueuing.FairQueue, r fairqueuing.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.requests[r] = true
+	c.flow(r).Waiting++
+}
+
+func (c *Collector) Dequeued(_ fairqueuing.FairQueue, r fairqueuing.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.requests[r] = false
+	c.observeWait(r)
+}
+
+func (c *Collector) DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType) {}
+
+func (c *Collector) Disposed(r fairqueuing.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.requests, r)
+	stats := c.flow(r)
+	stats.Executed++
+	seats, _ := r.EstimateCost()
+	_, execution := r.LatencyTrackers().ExecutionDuration.Get()
+	stats.Served += float64(seats) * execution.Seconds()
+}
+
+func (c *Collector) Rejected(r fairqueuing.Request, _ fairqueuing.RejectReason) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	waiting, selected := c.requests[r]
+	switch {
+	case !selected:
+		// rejected before a queue was selected for it
+		c.arrived(r)
+	case waiting:
+		c.observeWait(r)
+	}
+	delete(c.requests, r)
+	c.flow(r).Rejected++
+}
+
+// Flows returns the stats of each flow seen so far, ordered by flow
+func (c *Collector) Flows() []FlowStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	flows := make([]FlowStats, 0, len(c.flows))
+	index := map[fairqueuing.FlowIDType]int{}
+	for id, stats := range c.flows {
+		index[id] = len(flows)
+		flows = append(flows, *stats)
+	}
+	for r, waiting := range c.requests {
+		if !waiting {
+			continue
+		}
+		stats := &flows[index[r.GetFlowID()]]
+		if wait := c.queueWait(r); wait > stats.MaxQueueWait {
+			stats.MaxQueueWait = wait
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Flow < flows[j].Flow })
+	return flows
+}
+
+// Report compares what each flow was served so far to its max-min
+// fair share of the given capacity, the capacity is the seat-seconds
+// the queueset could have served, its total seats times the elapsed
+// time, for example.
+func (c *Collector) Report(capacity float64) *Report {
+	flows := c.Flows()
+	demands, served := make([]float64, len(flows)), make([]float64, len(flows))
+	for i := range flows {
+		demands[i], served[i] = flows[i].Demand, flows[i].Served
+	}
+	shares := MaxMinFairShares(demands, capacity)
+
+	report := &Report{
+		Fairness:        Fairness(served, shares),
+		MaxMinDeviation: MaxMinDeviation(served, shares),
+	}
+	for i := range flows {
+		report.Flows = append(report.Flows, FlowReport{FlowStats: flows[i], FairShare: shares[i]})
+	}
+	return report
+}
+
+// Report tells how fairly the flows were served
+type Report struct {
+	Flows []FlowReport
+
+	// Fairness is the Jain's fairness index of the seat-seconds served
+	// to the flows, each relative to the fair share of the flow; it is
+	// 1 if every flow got its fair share.
+	Fairness float64
+
+	// MaxMinDeviation is the largest shortfall of a flow from its fair
+	// share, relative to the share.
+	MaxMinDeviation float64
+}
+
+// FlowReport holds the stats of a flow, and its max-min fair share of
+// the seat-seconds.
+type FlowReport struct {
+	FlowStats
+	FairShare float64
+}
+
+// Starved returns the flows that had a request wait in queue for at
+// least the given threshold, or that were not served at all although
+// they have a fair share.
+func (r *Report) Starved(threshold time.Duration) []fairqueuing.FlowIDType {
+	var starved []fairqueuing.FlowIDType
+	for _, flow := range r.Flows {
+		if flow.MaxQueueWait >= threshold || (flow.FairShare > 0 && flow.Served == 0) {
+			starved = append(starved, flow.Flow)
+		}
+	}
+	return starved
+}
@@ -0,0 +1,86 @@
+// Package fairness measures how fairly a queueset serves its flows:
+// the seat-seconds served to each flow are compared to its max-min fair
+// share of the capacity of the queueset.
+package fairness
+
+import (
+	"sort"
+)
+
+// MaxMinFairShares divides the capacity among the given demands by
+// water filling: no demand gets more than it asks for, and what is
+// left is divided evenly among the demands that want more.
+func MaxMinFairShares(demands []float64, capacity float64) []float64 {
+	shares := make([]float64, len(demands))
+	order := make([]int, len(demands))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return demands[order[i]] < demands[order[j]] })
+
+	for n, i := range order {
+		share := capacity / float64(len(order)-n)
+		if demands[i] < share {
+			share = demands[i]
+		}
+		shares[i] = share
+		capacity -= share
+	}
+	return shares
+}
+
+// JainsIndex returns (sum x)^2 / (n * sum x^2), it is 1 if all the
+// values are the same, and 1/n if one value takes it all.
+func JainsIndex(values []float64) float64 {
+	var sum, sumOfSquares float64
+	for _, x := range values {
+		sum += x
+		sumOfSquares += x * x
+	}
+	if sumOfSquares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(values)) * sumOfSquares)
+}
+
+// MaxMinDeviation returns the largest shortfall of what was served
+// from the fair share, relative to the fair share; it is 0 if every
+// flow was served at least its fair share, and 1 if a flow with a
+// fair share was not served at all.
+func MaxMinDeviation(served, shares []float64) float64 {
+	var deviation float64
+	for i, share := range shares {
+		if share <= 0 {
+			continue
+		}
+		if d := (share - served[i]) / share; d > deviation {
+			deviation = d
+		}
+	}
+	return deviation
+}
+
+// Fairness returns the Jain's index of what was served to each flow
+// with a fair share, relative to the share; it is 1 if every such flow
+// was served at least its fair share.
+func Fairness(served, shares []float64) float64 {
+	return JainsIndex(normalize(served, shares))
+}
+
+// normalize returns what was served to each flow with a fair share,
+// relative to the share; serving more than the fair share is not held
+// against the queueset, the capacity may have been spare.
+func normalize(served, shares []float64) []float64 {
+	normalized := make([]float64, 0, len(shares))
+	for i, share := range shares {
+		if share <= 0 {
+			continue
+		}
+		x := served[i] / share
+		if x > 1 {
+			x = 1
+		}
+		normalized = append(normalized, x)
+	}
+	return normalized
+}
@@ -0,0 +1,85 @@
+package fairness
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+func TestMaxMinFairShares(t *testing.T) {
+	tests := []struct {
+		demands  []float64
+		capacity float64
+		want     []float64
+	}{
+		{demands: []float64{1, 2, 3}, capacity: 10, want: []float64{1, 2, 3}},
+		{demands: []float64{10, 1, 10}, capacity: 9, want: []float64{4, 1, 4}},
+		{demands: []float64{0, 10}, capacity: 4, want: []float64{0, 4}},
+	}
+	for _, test := range tests {
+		if got := MaxMinFairShares(test.demands, test.capacity); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("demands: %v, capacity: %v, expected shares: %v, but got: %v", test.demands, test.capacity, test.want, got)
+		}
+	}
+}
+
+func TestJainsIndex(t *testing.T) {
+	if got := JainsIndex([]float64{1, 1, 1, 1}); got != 1 {
+		t.Errorf("expected an index of 1 for equal values, but got: %f", got)
+	}
+	if got := JainsIndex([]float64{1, 0, 0, 0}); got != 0.25 {
+		t.Errorf("expected an index of 1/n if one value takes it all, but got: %f", got)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	tests := []struct {
+		served, shares []float64
+		want           float64
+	}{
+		{served: []float64{4, 1, 4}, shares: []float64{4, 1, 4}, want: 1},
+		// serving more than the fair share is not held against the queueset
+		{served: []float64{8, 1, 4}, shares: []float64{4, 1, 4}, want: 1},
+		// a flow without a fair share is left out
+		{served: []float64{0, 2, 2}, shares: []float64{0, 2, 2}, want: 1},
+		{served: []float64{4, 0}, shares: []float64{4, 4}, want: 0.5},
+	}
+	for _, test := range tests {
+		if got := Fairness(test.served, test.shares); got != test.want {
+			t.Errorf("served: %v, shares: %v, expected fairness: %v, but got: %v", test.served, test.shares, test.want, got)
+		}
+	}
+}
+
+func TestMaxMinDeviation(t *testing.T) {
+	tests := []struct {
+		served, shares []float64
+		want           float64
+	}{
+		{served: []float64{4, 1, 4}, shares: []float64{4, 1, 4}, want: 0},
+		{served: []float64{8, 1, 0}, shares: []float64{4, 1, 4}, want: 1},
+		{served: []float64{3, 1, 5}, shares: []float64{4, 1, 4}, want: 0.25},
+		{served: []float64{0, 2}, shares: []float64{0, 2}, want: 0},
+	}
+	for _, test := range tests {
+		if got := MaxMinDeviation(test.served, test.shares); got != test.want {
+			t.Errorf("served: %v, shares: %v, expected deviation: %v, but got: %v", test.served, test.shares, test.want, got)
+		}
+	}
+}
+
+func TestStarved(t *testing.T) {
+	report := &Report{
+		Flows: []FlowReport{
+			{FlowStats: FlowStats{Flow: 1, Served: 1, MaxQueueWait: time.Second}, FairShare: 1},
+			{FlowStats: FlowStats{Flow: 2, Served: 1, MaxQueueWait: 5 * time.Second}, FairShare: 1},
+			{FlowStats: FlowStats{Flow: 3}, FairShare: 1},
+			{FlowStats: FlowStats{Flow: 4}},
+		},
+	}
+	if want, got := []fairqueuing.FlowIDType{2, 3}, report.Starved(2*time.Second); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected the starved flows to be: %v, but got: %v", want, got)
+	}
+}
@@ -0,0 +1,47 @@
+// Package fairnesstest provides assertions on a fairness report, for
+// the tests of a queueset.
+package fairnesstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/fairness"
+)
+
+// ExpectFairShare fails the test if a flow was served less than the
+// given fraction of its max-min fair share.
+func ExpectFairShare(t testing.TB, report *fairness.Report, fraction float64) {
+	t.Helper()
+	for _, flow := range report.Flows {
+		if want := fraction * flow.FairShare; flow.Served < want {
+			t.Errorf("flow %d: expected at least %.0f%% of its fair share of %.2f seat-seconds, but got: %.2f (%+v)",
+				flow.Flow, 100*fraction, flow.FairShare, flow.Served, flow.FlowStats)
+		}
+	}
+}
+
+// ExpectFairness fails the test if the Jain's fairness index of the
+// report is less than the given index.
+func ExpectFairness(t testing.TB, report *fairness.Report, index float64) {
+	t.Helper()
+	if report.Fairness < index {
+		t.Errorf("expected a fairness index of at least %.3f, but got: %.3f", index, report.Fairness)
+	}
+}
+
+// ExpectNoStarvation fails the test if a flow had a request wait in
+// queue for at least the given threshold, or was not served at all.
+func ExpectNoStarvation(t testing.TB, report *fairness.Report, threshold time.Duration) {
+	t.Helper()
+	starved := map[fairqueuing.FlowIDType]bool{}
+	for _, id := range report.Starved(threshold) {
+		starved[id] = true
+	}
+	for _, flow := range report.Flows {
+		if starved[flow.Flow] {
+			t.Errorf("flow %d: expected no request to wait %s or more, and to be served, but got: %+v", flow.Flow, threshold, flow.FlowStats)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package fairqueuing
 
 import (
 	"context"
+	"time"
 
 	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
 )
@@ -20,6 +21,21 @@ type Request interface {
 	LatencyTrackers() LatencyTrackers
 }
 
+// WaitBudgeter is implemented by the requests that are rejected on
+// arrival if they are expected to wait in queue for longer than their
+// budget, ok is false if the request has no budget.
+type WaitBudgeter interface {
+	WaitBudget() (budget time.Duration, ok bool)
+}
+
+// AdditionalWorker is implemented by the requests that are charged for
+// more work than they occupy their seats for, like a long-running
+// request that keeps the server busy once it releases its seats. The
+// additional work is part of the width EstimateCost returns.
+type AdditionalWorker interface {
+	AdditionalWork() virtual.SeatSeconds
+}
+
 type FairQueueAccessor interface {
 	TotalQueues() int
 	GetFairQueue(int) FairQueue
@@ -29,9 +45,19 @@ type QueueSelector interface {
 	SelectQueue(FairQueueAccessor, FlowIDType) (FairQueue, error)
 }
 
+// ReconfigurableQueueSelector is a QueueSelector that can adapt to a
+// change in the number of queues, or the hand size of a queue set.
+type ReconfigurableQueueSelector interface {
+	QueueSelector
+	Reconfigure(nQueues, handSize int) error
+}
+
 type LatencyTracker interface {
 	Start()
 	Finish()
+	// Get returns when the tracker was started, and the duration
+	// between start and finish.
+	Get() (startedAt time.Time, duration time.Duration)
 }
 
 type LatencyTrackers struct {
@@ -42,8 +68,8 @@ type LatencyTrackers struct {
 }
 
 type SeatCount struct {
-	InUse   uint32
-	Waiting uint32
+	InUse   uint32 `json:"inUse"`
+	Waiting uint32 `json:"waiting"`
 }
 
 func (sc SeatCount) Total() uint32 {
@@ -51,8 +77,8 @@ func (sc SeatCount) Total() uint32 {
 }
 
 type RequestCount struct {
-	Executing uint32
-	Waiting   uint32
+	Executing uint32 `json:"executing"`
+	Waiting   uint32 `json:"waiting"`
 }
 
 func (rc RequestCount) Total() uint32 {
@@ -66,8 +92,9 @@ type DecisionType int
 const (
 	DecisionNone DecisionType = iota
 
-	// This one's context timed out / was canceled
-	DecisionTimeout
+	// This one was rejected while waiting in queue, the reason is
+	// given by the RejectReason of the request
+	DecisionReject
 
 	// Serve this one
 	DecisionExecute
@@ -75,10 +102,15 @@ const (
 
 type DecisionSetter interface {
 	SetDecision(DecisionType) bool
+	// Reject sets the decision to DecisionReject for the given reason
+	Reject(RejectReason) bool
 }
 
 type DecisionWaiter interface {
 	WaitForDecision() DecisionType
+	// RejectReason returns why the request was rejected, it returns
+	// RejectReasonNone until a decision to reject has been made.
+	RejectReason() RejectReason
 }
 
 type DecisionWaiterSetter interface {
@@ -0,0 +1,204 @@
+package prioritylevel
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// seatDemandSmoothingCoefficient is the rate at which the smoothed
+// seat demand of a priority level decays when the observed demand
+// drops, it is the same as upstream APF.
+const seatDemandSmoothingCoefficient = 0.977
+
+// seatAdjuster is implemented by the queuesets that can lend seats to,
+// or borrow seats from other priority levels.
+type seatAdjuster interface {
+	SetTotalSeats(uint32)
+	ResetSeatDemand() (highWatermark uint32)
+}
+
+func newLendingLevel(config Config, qs seatAdjuster) (*lendingLevel, error) {
+	if config.LendablePercent < 0 || config.LendablePercent > 100 {
+		return nil, fmt.Errorf("lendable percent %d must be in the range [0, 100]", config.LendablePercent)
+	}
+	if config.BorrowingLimitPercent != nil && *config.BorrowingLimitPercent < 0 {
+		return nil, fmt.Errorf("borrowing limit percent %d must not be negative", *config.BorrowingLimitPercent)
+	}
+
+	nominal := float64(config.QueueSet.TotalSeats)
+	level := &lendingLevel{
+		name:    config.Name,
+		qs:      qs,
+		nominal: nominal,
+		// a level keeps a seat however much of it is lendable, a
+		// queueset without seats never dispatches, its requests
+		// would wait until they time out.
+		minSeats: math.Max(1, nominal-math.Round(nominal*float64(config.LendablePercent)/100)),
+		maxSeats: math.Inf(1),
+		current:  nominal,
+	}
+	if config.BorrowingLimitPercent != nil {
+		level.maxSeats = nominal + math.Round(nominal*float64(*config.BorrowingLimitPercent)/100)
+	}
+	return level, nil
+}
+
+// lendingLevel holds the state of a priority level that takes part in
+// seat borrowing.
+type lendingLevel struct {
+	name string
+	qs   seatAdjuster
+
+	// nominal is the number of seats configured for the priority
+	// level, and the range [minSeats, maxSeats] bounds the number of
+	// seats it may use after lending or borrowing.
+	nominal, minSeats, maxSeats float64
+
+	// current is the number of seats assigned by the last rebalance
+	current float64
+
+	// smoothedDemand tracks the observed seat demand, it rises
+	// immediately with the demand but decays slowly.
+	smoothedDemand float64
+}
+
+// Run rebalances the seats among the priority levels every period
+// until the given context is done.
+func (c *controller) Run(ctx context.Context, clock clock.WithTicker, period time.Duration) {
+	ticker := clock.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			c.Rebalance()
+		}
+	}
+}
+
+// Rebalance moves seats between the priority levels based on the seat
+// demand observed since the last rebalance. The sum of the seats of
+// all priority levels stays at the sum of their nominal seats, unless
+// the borrowing limits prevent the levels from using all of them.
+func (c *controller) Rebalance() {
+	c.rebalanceLock.Lock()
+	defer c.rebalanceLock.Unlock()
+
+	if len(c.lending) == 0 {
+		return
+	}
+
+	var total, targets float64
+	bounds := make([]allocationBounds, len(c.lending))
+	for i, level := range c.lending {
+		demand := float64(level.qs.ResetSeatDemand())
+		level.smoothedDemand = math.Max(demand, seatDemandSmoothingCoefficient*level.smoothedDemand)
+		total += level.nominal
+		bounds[i] = allocationBounds{
+			lower:  level.minSeats,
+			target: math.Max(level.smoothedDemand, level.minSeats),
+			upper:  level.maxSeats,
+		}
+		targets += bounds[i].target
+	}
+	if targets == 0 {
+		// none of the levels has any demand, go back to nominal
+		for i, level := range c.lending {
+			bounds[i].target = level.nominal
+		}
+	}
+
+	allocations := computeFairAllocation(total, bounds)
+	for i, level := range c.lending {
+		if allocations[i] == level.current {
+			continue
+		}
+		level.current = allocations[i]
+		level.qs.SetTotalSeats(uint32(allocations[i]))
+	}
+}
+
+// Seats returns the number of seats assigned to the given priority
+// level by the last rebalance.
+func (c *controller) Seats(name string) (uint32, bool) {
+	c.rebalanceLock.Lock()
+	defer c.rebalanceLock.Unlock()
+
+	for _, level := range c.lending {
+		if level.name == name {
+			return uint32(level.current), true
+		}
+	}
+	return 0, false
+}
+
+type allocationBounds struct {
+	lower, target, upper float64
+}
+
+// computeFairAllocation divides total seats among the priority levels,
+// each level gets a common proportion of its target, clipped to its
+// bounds. The returned allocations are whole numbers that add up to
+// total, unless the bounds of the levels do not permit it.
+func computeFairAllocation(total float64, bounds []allocationBounds) []float64 {
+	allocate := func(proportion float64) ([]float64, float64) {
+		allocations := make([]float64, len(bounds))
+		var sum float64
+		for i, b := range bounds {
+			allocations[i] = math.Max(b.lower, math.Min(b.upper, proportion*b.target))
+			sum += allocations[i]
+		}
+		return allocations, sum
+	}
+
+	// the sum of the allocations does not decrease as the proportion
+	// grows, find the proportion at which it reaches total.
+	low, high := 0.0, 1.0
+	for _, sum := allocate(high); sum < total; _, sum = allocate(high) {
+		if high > 1e15 {
+			// the upper bounds do not allow for total
+			break
+		}
+		high *= 2
+	}
+	for i := 0; i < 64; i++ {
+		mid := (low + high) / 2
+		if _, sum := allocate(mid); sum < total {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	allocations, _ := allocate(high)
+
+	// round down, and hand out the seats that are left to the levels
+	// with the largest fractional part, ties go to the earlier level.
+	var sum float64
+	order := make([]int, len(allocations))
+	fractions := make([]float64, len(allocations))
+	for i := range allocations {
+		order[i] = i
+		fractions[i] = allocations[i] - math.Floor(allocations[i])
+		allocations[i] = math.Floor(allocations[i])
+		sum += allocations[i]
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return fractions[order[i]] > fractions[order[j]]
+	})
+	for _, i := range order {
+		if sum >= total {
+			break
+		}
+		if allocations[i]+1 <= bounds[i].upper {
+			allocations[i]++
+			sum++
+		}
+	}
+	return allocations
+}
@@ -0,0 +1,235 @@
+package prioritylevel
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestComputeFairAllocation(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name   string
+		total  float64
+		bounds []allocationBounds
+		want   []float64
+	}{
+		{
+			name:  "demand matches nominal",
+			total: 20,
+			bounds: []allocationBounds{
+				{lower: 5, target: 10, upper: inf},
+				{lower: 5, target: 10, upper: inf},
+			},
+			want: []float64{10, 10},
+		},
+		{
+			name:  "idle level lends up to its lendable seats",
+			total: 20,
+			bounds: []allocationBounds{
+				{lower: 5, target: 5, upper: inf},
+				{lower: 10, target: 18, upper: inf},
+			},
+			want: []float64{5, 15},
+		},
+		{
+			name:  "borrowing limit caps the busy level",
+			total: 20,
+			bounds: []allocationBounds{
+				{lower: 0, target: 0.5, upper: inf},
+				{lower: 10, target: 30, upper: 12},
+			},
+			want: []float64{8, 12},
+		},
+		{
+			name:  "upper bounds do not permit the total",
+			total: 20,
+			bounds: []allocationBounds{
+				{lower: 5, target: 30, upper: 6},
+				{lower: 5, target: 30, upper: 6},
+			},
+			want: []float64{6, 6},
+		},
+		{
+			name:  "remainder goes to the largest fraction",
+			total: 10,
+			bounds: []allocationBounds{
+				{lower: 0, target: 1, upper: inf},
+				{lower: 0, target: 2, upper: inf},
+				{lower: 0, target: 4, upper: inf},
+			},
+			want: []float64{1, 3, 6},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := computeFairAllocation(test.total, test.bounds)
+			if fmt.Sprint(test.want) != fmt.Sprint(got) {
+				t.Errorf("expected allocation: %v, but got: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	twenty := 20
+	tests := []struct {
+		name                  string
+		borrowingLimitPercent *int
+		wantIdle, wantBusy    uint32
+	}{
+		{
+			name:     "busy level borrows all the lendable seats",
+			wantIdle: 5, wantBusy: 15,
+		},
+		{
+			name:                  "busy level borrows up to its limit",
+			borrowingLimitPercent: &twenty,
+			wantIdle:              8, wantBusy: 12,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeClock := clocktesting.NewFakeClock(time.Now())
+			c, err := NewController(
+				Config{Name: "idle", QueueSet: newBorrowingQueueSetConfig(fakeClock), LendablePercent: 50},
+				Config{Name: "busy", QueueSet: newBorrowingQueueSetConfig(fakeClock), BorrowingLimitPercent: test.borrowingLimitPercent},
+			)
+			if err != nil {
+				t.Fatalf("failed to create controller: %v", err)
+			}
+
+			busy, _ := c.Get("busy")
+			for i := 0; i < 18; i++ {
+				if _, err := busy.EnqueueAndDispatch(newRequest()); err != nil {
+					t.Fatalf("failed to enqueue: %v", err)
+				}
+			}
+
+			c.Rebalance()
+			for name, want := range map[string]uint32{"idle": test.wantIdle, "busy": test.wantBusy} {
+				if got, _ := c.Seats(name); want != got {
+					t.Errorf("expected %q to have %d seats, but got: %d", name, want, got)
+				}
+				qs, _ := c.Get(name)
+				if got := qs.(queuesetTotalSeats).TotalSeats(); want != got {
+					t.Errorf("expected queueset %q to have %d seats, but got: %d", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLendingEverySeat(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	c, err := NewController(
+		Config{Name: "idle", QueueSet: newBorrowingQueueSetConfig(fakeClock), LendablePercent: 100},
+		Config{Name: "busy", QueueSet: newBorrowingQueueSetConfig(fakeClock)},
+	)
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	busy, _ := c.Get("busy")
+	for i := 0; i < 30; i++ {
+		if _, err := busy.EnqueueAndDispatch(newRequest()); err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+	}
+
+	// the idle level lends every seat it may, it keeps one so its
+	// requests are still dispatched.
+	c.Rebalance()
+	for name, want := range map[string]uint32{"idle": 1, "busy": 19} {
+		if got, _ := c.Seats(name); want != got {
+			t.Errorf("expected %q to have %d seats, but got: %d", name, want, got)
+		}
+	}
+	if t.Failed() {
+		// a level without seats never executes the request
+		t.FailNow()
+	}
+
+	idle, _ := c.Get("idle")
+	finisher, err := idle.EnqueueAndDispatch(newRequest())
+	if err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+	var executed bool
+	finisher.Finish(func() { executed = true })
+	if !executed {
+		t.Errorf("expected the request of the idle level to be executed")
+	}
+}
+
+func TestRunRebalancesPeriodically(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	c, err := NewController(
+		Config{Name: "idle", QueueSet: newBorrowingQueueSetConfig(fakeClock), LendablePercent: 100},
+		Config{Name: "busy", QueueSet: newBorrowingQueueSetConfig(fakeClock)},
+	)
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	busy, _ := c.Get("busy")
+	for i := 0; i < 30; i++ {
+		busy.EnqueueAndDispatch(newRequest())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, fakeClock, time.Second)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// nothing should change until the period elapses
+	if got, _ := c.Seats("busy"); got != 10 {
+		t.Errorf("expected the busy level to keep its nominal seats before the period elapses, but got: %d", got)
+	}
+	for !fakeClock.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	fakeClock.Step(time.Second)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if got, _ := c.Seats("busy"); got == 19 {
+			break
+		}
+		if time.Now().After(deadline) {
+			got, _ := c.Seats("busy")
+			t.Fatalf("expected the busy level to borrow all the seats but one, but got: %d", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newBorrowingQueueSetConfig(clock *clocktesting.FakeClock) *queueset.Config {
+	return &queueset.Config{
+		TotalSeats: 10,
+		QueuingConfig: &queueset.QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+		Clock:         clock,
+		Events:        noopEvents{},
+	}
+}
+
+type queuesetTotalSeats interface {
+	TotalSeats() uint32
+}
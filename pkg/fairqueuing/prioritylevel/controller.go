@@ -0,0 +1,239 @@
+package prioritylevel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+)
+
+// Config describes a priority level
+type Config struct {
+	// Name of the priority level, it must be unique
+	Name string
+
+	// Exempt, if true, requests that belong to this priority level
+	// are not subject to fair queuing, they are executed immediately.
+	Exempt bool
+
+	// QueueSet is the configuration of the queueset that backs the
+	// priority level, it is ignored if the priority level is exempt.
+	// If no QueueSelector is specified, shuffle sharding is used
+	// with the given number of queues and hand size.
+	// TotalSeats is the nominal number of seats of the priority level.
+	QueueSet *queueset.Config
+
+	// LendablePercent is the percentage of the nominal seats of
+	// the priority level that may be lent to other levels, in
+	// the range [0, 100]; the level keeps at least one seat.
+	LendablePercent int
+
+	// BorrowingLimitPercent, if specified, limits the number of seats
+	// the priority level may borrow from other levels, as a percentage
+	// of its nominal seats. If nil, there is no limit.
+	BorrowingLimitPercent *int
+}
+
+// NewController returns a Controller that owns a queueset for each
+// of the given priority levels.
+func NewController(configs ...Config) (*controller, error) {
+	c := &controller{levels: map[string]fairqueuing.FairQueueSet{}}
+	if err := c.Reconfigure(configs...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type controller struct {
+	lock   sync.RWMutex
+	levels map[string]fairqueuing.FairQueueSet
+
+	// lending holds the non-exempt priority levels in the order of
+	// their names, it is guarded by rebalanceLock
+	rebalanceLock sync.Mutex
+	lending       []*lendingLevel
+}
+
+// reconfigurer is implemented by the queuesets that can be
+// reconfigured in place.
+type reconfigurer interface {
+	Reconfigure(*queueset.Config) error
+}
+
+// shutdowner is implemented by the queuesets that can be drained
+type shutdowner interface {
+	Shutdown(context.Context) error
+}
+
+// Shutdown shuts down the queuesets of all priority levels at once,
+// and returns when they are all done, see the Shutdown of queueset.
+// The exempt priority levels keep executing requests.
+func (c *controller) Shutdown(ctx context.Context) error {
+	c.lock.RLock()
+	levels := make(map[string]shutdowner, len(c.levels))
+	for name, qs := range c.levels {
+		if s, ok := qs.(shutdowner); ok {
+			levels[name] = s
+		}
+	}
+	c.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(levels))
+	for name, s := range levels {
+		wg.Add(1)
+		go func(name string, s shutdowner) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				errCh <- fmt.Errorf("priority level %q: %w", name, err)
+			}
+		}(name, s)
+	}
+	wg.Wait()
+	close(errCh)
+
+	var errs []error
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Get returns the queueset of the given priority level
+func (c *controller) Get(name string) (fairqueuing.FairQueueSet, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	qs, ok := c.levels[name]
+	return qs, ok
+}
+
+// Reconfigure replaces the priority levels of the controller with the
+// given ones. The queueset of a priority level that already exists is
+// reconfigured in place, so the requests waiting or executing in it
+// are not affected. A priority level that is no longer specified is
+// removed, the requests already in it finish as usual, but no new
+// request can get to it.
+//
+// The configurations of all the priority levels, and of their
+// queuesets, are validated before any change is made, so an invalid
+// configuration leaves the priority levels unchanged.
+func (c *controller) Reconfigure(configs ...Config) error {
+	queueSetConfigs := make([]*queueset.Config, len(configs))
+	names := map[string]bool{}
+	for i, config := range configs {
+		if len(config.Name) == 0 {
+			return fmt.Errorf("priority level name must not be empty")
+		}
+		if names[config.Name] {
+			return fmt.Errorf("priority level %q is specified more than once", config.Name)
+		}
+		names[config.Name] = true
+		if config.Exempt {
+			continue
+		}
+
+		qsConfig, err := newQueueSetConfig(config)
+		if err != nil {
+			return fmt.Errorf("priority level %q: %w", config.Name, err)
+		}
+		if err := queueset.Validate(qsConfig); err != nil {
+			return fmt.Errorf("priority level %q: %w", config.Name, err)
+		}
+		if _, err := newLendingLevel(config, nil); err != nil {
+			return fmt.Errorf("priority level %q: %w", config.Name, err)
+		}
+		queueSetConfigs[i] = qsConfig
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rebalanceLock.Lock()
+	defer c.rebalanceLock.Unlock()
+
+	previous := map[string]*lendingLevel{}
+	for _, level := range c.lending {
+		previous[level.name] = level
+	}
+
+	levels := map[string]fairqueuing.FairQueueSet{}
+	var lending []*lendingLevel
+	for i, config := range configs {
+		if config.Exempt {
+			qs, ok := c.levels[config.Name].(*exemptQueueSet)
+			if !ok {
+				qs = newExemptQueueSet(config.Name)
+			}
+			levels[config.Name] = qs
+			continue
+		}
+
+		qs, ok := c.levels[config.Name].(reconfigurer)
+		if ok {
+			if err := qs.Reconfigure(queueSetConfigs[i]); err != nil {
+				return fmt.Errorf("priority level %q: %w", config.Name, err)
+			}
+		} else {
+			created, err := queueset.NewQueueSet(queueSetConfigs[i])
+			if err != nil {
+				return fmt.Errorf("priority level %q: %w", config.Name, err)
+			}
+			qs = created
+		}
+		levels[config.Name] = qs.(fairqueuing.FairQueueSet)
+
+		level, err := newLendingLevel(config, qs.(seatAdjuster))
+		if err != nil {
+			return fmt.Errorf("priority level %q: %w", config.Name, err)
+		}
+		if old, ok := previous[config.Name]; ok {
+			level.smoothedDemand = old.smoothedDemand
+		}
+		lending = append(lending, level)
+	}
+	sort.Slice(lending, func(i, j int) bool {
+		return lending[i].name < lending[j].name
+	})
+
+	c.levels = levels
+	c.lending = lending
+	return nil
+}
+
+// Names returns the names of all priority levels in sorted order
+func (c *controller) Names() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	names := make([]string, 0, len(c.levels))
+	for name := range c.levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newQueueSetConfig returns the configuration of the queueset of the
+// given non-exempt priority level.
+func newQueueSetConfig(config Config) (*queueset.Config, error) {
+	if config.QueueSet == nil || config.QueueSet.QueuingConfig == nil {
+		return nil, fmt.Errorf("queueset configuration must be specified")
+	}
+
+	// the caller owns the given configuration, make a copy
+	qsConfig := *config.QueueSet
+	qsConfig.Name = config.Name
+	if qsConfig.QueueSelector == nil {
+		selector, err := queueselector.NewShuffleShardingQueueSelector(qsConfig.QueuingConfig.NQueues, qsConfig.QueuingConfig.HandSize)
+		if err != nil {
+			return nil, err
+		}
+		qsConfig.QueueSelector = selector
+	}
+	return &qsConfig, nil
+}
@@ -0,0 +1,261 @@
+package prioritylevel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/promise"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestNewController(t *testing.T) {
+	newQueueSetConfig := func() *queueset.Config {
+		return &queueset.Config{
+			TotalSeats: 10,
+			QueuingConfig: &queueset.QueuingConfig{
+				NQueues:        16,
+				HandSize:       4,
+				QueueMaxLength: 10,
+			},
+			Clock:  clocktesting.NewFakeClock(time.Now()),
+			Events: noopEvents{},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		configs []Config
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "exempt, workload-high and catch-all levels",
+			configs: []Config{
+				{Name: "exempt", Exempt: true},
+				{Name: "workload-high", QueueSet: newQueueSetConfig()},
+				{Name: "catch-all", QueueSet: newQueueSetConfig()},
+			},
+			want: []string{"catch-all", "exempt", "workload-high"},
+		},
+		{
+			name:    "empty name",
+			configs: []Config{{Exempt: true}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate name",
+			configs: []Config{
+				{Name: "catch-all", QueueSet: newQueueSetConfig()},
+				{Name: "catch-all", Exempt: true},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "queueset configuration missing",
+			configs: []Config{{Name: "catch-all"}},
+			wantErr: true,
+		},
+		{
+			name: "invalid hand size",
+			configs: []Config{
+				{Name: "catch-all", QueueSet: &queueset.Config{
+					TotalSeats:    1,
+					QueuingConfig: &queueset.QueuingConfig{NQueues: 2, HandSize: 4},
+				}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewController(test.configs...)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got: %v", err)
+			}
+
+			names := c.Names()
+			if len(names) != len(test.want) {
+				t.Fatalf("expected priority levels: %v, but got: %v", test.want, names)
+			}
+			for i := range names {
+				if names[i] != test.want[i] {
+					t.Errorf("expected priority levels: %v, but got: %v", test.want, names)
+				}
+				qs, ok := c.Get(names[i])
+				if !ok {
+					t.Fatalf("expected priority level %q to exist", names[i])
+				}
+				if qs.Name() != names[i] {
+					t.Errorf("expected queueset name: %q, but got: %q", names[i], qs.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	c, err := NewController(
+		Config{Name: "exempt", Exempt: true},
+		Config{Name: "catch-all", QueueSet: newBorrowingQueueSetConfig(fakeClock)},
+	)
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	before, _ := c.Get("catch-all")
+
+	grown := newBorrowingQueueSetConfig(fakeClock)
+	grown.TotalSeats = 20
+	if err := c.Reconfigure(
+		Config{Name: "catch-all", QueueSet: grown},
+		Config{Name: "workload-high", QueueSet: newBorrowingQueueSetConfig(fakeClock)},
+	); err != nil {
+		t.Fatalf("failed to reconfigure: %v", err)
+	}
+
+	if want, got := []string{"catch-all", "workload-high"}, c.Names(); fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("expected priority levels: %v, but got: %v", want, got)
+	}
+	after, _ := c.Get("catch-all")
+	if before != after {
+		t.Errorf("expected the queueset of catch-all to be reconfigured in place")
+	}
+	if seats, _ := c.Seats("catch-all"); seats != 20 || after.(queuesetTotalSeats).TotalSeats() != 20 {
+		t.Errorf("expected catch-all to have 20 seats, but got: %d", seats)
+	}
+
+	// an invalid configuration changes nothing
+	if err := c.Reconfigure(Config{Name: "catch-all"}); err == nil {
+		t.Errorf("expected an error")
+	}
+	if len(c.Names()) != 2 {
+		t.Errorf("expected the priority levels to be unchanged, but got: %v", c.Names())
+	}
+
+	// nor does one that is invalid for the queueset of a level that
+	// comes after a valid one.
+	shrunk, invalid := newBorrowingQueueSetConfig(fakeClock), newBorrowingQueueSetConfig(fakeClock)
+	shrunk.TotalSeats, invalid.TotalSeats = 5, 0
+	if err := c.Reconfigure(
+		Config{Name: "catch-all", QueueSet: shrunk},
+		Config{Name: "workload-high", QueueSet: invalid},
+	); err == nil {
+		t.Errorf("expected an error")
+	}
+	if seats, _ := c.Seats("catch-all"); seats != 20 || after.(queuesetTotalSeats).TotalSeats() != 20 {
+		t.Errorf("expected catch-all to keep its 20 seats, but got: %d", after.(queuesetTotalSeats).TotalSeats())
+	}
+}
+
+func TestExemptLevelExecutesImmediately(t *testing.T) {
+	c, err := NewController(Config{Name: "exempt", Exempt: true})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	qs, _ := c.Get("exempt")
+
+	finisher, err := qs.EnqueueAndDispatch(newRequest())
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	// the request is executed once, however many times, and from
+	// however many goroutines it is finished.
+	var executed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			finisher.Finish(func() { atomic.AddInt32(&executed, 1) })
+		}()
+	}
+	wg.Wait()
+	if executed != 1 {
+		t.Errorf("expected the request to be executed once, but it was executed %d times", executed)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c, err := NewController(
+		Config{Name: "exempt", Exempt: true},
+		Config{Name: "catch-all", QueueSet: newBorrowingQueueSetConfig(clocktesting.NewFakeClock(time.Now()))},
+	)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("expected no error, but got: %v", err)
+	}
+
+	qs, _ := c.Get("catch-all")
+	if _, err := qs.EnqueueAndDispatch(newRequest()); err == nil {
+		t.Errorf("expected the request to be rejected after shutdown")
+	}
+	qs, _ = c.Get("exempt")
+	if _, err := qs.EnqueueAndDispatch(newRequest()); err != nil {
+		t.Errorf("expected the exempt level to keep executing requests, but got: %v", err)
+	}
+}
+
+type testRequest struct {
+	virtual.RTracker
+	fairqueuing.DecisionWaiterSetter
+}
+
+func newRequest() *testRequest {
+	return &testRequest{
+		RTracker:             virtual.NewRTracker(),
+		DecisionWaiterSetter: promise.New(context.Background()),
+	}
+}
+
+func (r *testRequest) GetFlowID() fairqueuing.FlowIDType { return 0 }
+func (r *testRequest) EstimateCost() (uint32, virtual.SeatSeconds) {
+	return 1, virtual.SeatsTimesDuration(1, time.Second)
+}
+func (r *testRequest) Context() context.Context       { return context.Background() }
+func (r *testRequest) CancelFunc() context.CancelFunc { return nil }
+func (r *testRequest) String() string                 { return "test" }
+func (r *testRequest) LatencyTrackers() fairqueuing.LatencyTrackers {
+	return fairqueuing.LatencyTrackers{
+		QueueWait:                 fakeLatencyTracker{},
+		PostDecisionExecutionWait: fakeLatencyTracker{},
+		ExecutionDuration:         fakeLatencyTracker{},
+		TotalDuration:             fakeLatencyTracker{},
+	}
+}
+
+type fakeLatencyTracker struct{}
+
+func (fakeLatencyTracker) Start()  {}
+func (fakeLatencyTracker) Finish() {}
+func (fakeLatencyTracker) Get() (time.Time, time.Duration) {
+	return time.Time{}, 0
+}
+
+type noopEvents struct{}
+
+func (noopEvents) QueueSelected(fairqueuing.FairQueue, fairqueuing.Request)      {}
+func (noopEvents) Enqueued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (noopEvents) Dequeued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (noopEvents) DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType) {}
+func (noopEvents) Disposed(fairqueuing.Request)                                  {}
+func (noopEvents) Rejected(fairqueuing.Request, fairqueuing.RejectReason)        {}
@@ -0,0 +1,57 @@
+package prioritylevel
+
+import (
+	"sync"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+func newExemptQueueSet(name string) *exemptQueueSet {
+	return &exemptQueueSet{name: name}
+}
+
+var _ fairqueuing.FairQueueSet = &exemptQueueSet{}
+
+// exemptQueueSet does not queue, any request is executed immediately
+type exemptQueueSet struct {
+	name string
+}
+
+func (qs *exemptQueueSet) Name() string {
+	return qs.name
+}
+
+func (qs *exemptQueueSet) Enqueue(r fairqueuing.Request) (fairqueuing.Finisher, error) {
+	return &exemptFinisher{request: r}, nil
+}
+
+func (qs *exemptQueueSet) Dispatch() (bool, error) {
+	return false, nil
+}
+
+func (qs *exemptQueueSet) EnqueueAndDispatch(r fairqueuing.Request) (fairqueuing.Finisher, error) {
+	return qs.Enqueue(r)
+}
+
+// exemptFinisher executes the request right away, like queuedFinisher,
+// only the first invocation of Finish executes it.
+type exemptFinisher struct {
+	request fairqueuing.Request
+	once    sync.Once
+}
+
+func (f *exemptFinisher) Finish(fn func()) {
+	f.once.Do(func() {
+		f.finish(fn)
+	})
+}
+
+func (f *exemptFinisher) finish(fn func()) {
+	trackers := f.request.LatencyTrackers()
+	trackers.TotalDuration.Start()
+	defer trackers.TotalDuration.Finish()
+
+	trackers.ExecutionDuration.Start()
+	defer trackers.ExecutionDuration.Finish()
+	fn()
+}
@@ -18,23 +18,47 @@ type promise struct {
 	setCh           chan struct{}
 	once            sync.Once
 	value           fairqueuing.DecisionType
+	reason          fairqueuing.RejectReason
 	queueTimeoutCtx context.Context
 }
 
+// WaitForDecision blocks until a decision is made, or the queue wait
+// context is done, in which case the request is rejected unless a
+// decision has been made in the meantime; the decision that was made
+// first is returned either way.
 func (p *promise) WaitForDecision() fairqueuing.DecisionType {
 	select {
 	case <-p.setCh:
 	case <-p.queueTimeoutCtx.Done():
-		p.SetDecision(fairqueuing.DecisionTimeout)
+		p.Reject(fairqueuing.QueueWaitRejectReason(p.queueTimeoutCtx.Err()))
 	}
+	<-p.setCh
 	return p.value
 }
 
+func (p *promise) RejectReason() fairqueuing.RejectReason {
+	select {
+	case <-p.setCh:
+		return p.reason
+	default:
+		return fairqueuing.RejectReasonNone
+	}
+}
+
 func (p *promise) SetDecision(t fairqueuing.DecisionType) bool {
+	return p.set(t, fairqueuing.RejectReasonNone)
+}
+
+func (p *promise) Reject(reason fairqueuing.RejectReason) bool {
+	return p.set(fairqueuing.DecisionReject, reason)
+}
+
+func (p *promise) set(t fairqueuing.DecisionType, reason fairqueuing.RejectReason) bool {
 	var ans bool
 	p.once.Do(func() {
 		defer close(p.setCh)
 		p.value = t
+		p.reason = reason
 		ans = true
 	})
 	return ans
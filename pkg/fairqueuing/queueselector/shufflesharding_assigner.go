@@ -21,13 +21,24 @@ type shuffleShardingQueueSelector struct {
 	dealer *Dealer
 }
 
+var _ fairqueuing.ReconfigurableQueueSelector = &shuffleShardingQueueSelector{}
+
+// Reconfigure rebuilds the Dealer with the given deck and hand size,
+// the selector is left unchanged if they are invalid.
+func (s *shuffleShardingQueueSelector) Reconfigure(deckSize, handSize int) error {
+	dealer, err := NewDealer(deckSize, handSize)
+	if err != nil {
+		return err
+	}
+	s.dealer = dealer
+	return nil
+}
+
 func (s *shuffleShardingQueueSelector) SelectQueue(queues fairqueuing.FairQueueAccessor, hash fairqueuing.FlowIDType) (fairqueuing.FairQueue, error) {
 	if s.dealer.DeckSize() != queues.TotalQueues() {
-		dealer, err := NewDealer(s.dealer.DeckSize(), s.dealer.HandSize())
-		if err != nil {
+		if err := s.Reconfigure(queues.TotalQueues(), s.dealer.HandSize()); err != nil {
 			return nil, err
 		}
-		s.dealer = dealer
 	}
 
 	var backHand [8]int
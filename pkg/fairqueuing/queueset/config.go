@@ -7,11 +7,18 @@ import (
 )
 
 type Config struct {
+	// Name of the queueset, it is the name of the priority
+	// level the queueset belongs to.
+	Name          string
 	TotalSeats    uint32
 	QueuingConfig *QueuingConfig
 	QueueSelector fairqueuing.QueueSelector
 	Clock         clock.Clock
 	Events        Events
+
+	// Limiter, if specified, adapts the number of seats the queueset
+	// may occupy to the latency of its requests, within TotalSeats.
+	Limiter Limiter
 }
 
 type QueuingConfig struct {
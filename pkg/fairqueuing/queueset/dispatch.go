@@ -0,0 +1,187 @@
+package queueset
+
+import (
+	"container/heap"
+
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+)
+
+// dispatchSelector picks the queue to dispatch from next, it is not
+// safe for concurrent use, the caller is expected to hold the queue
+// set lock.
+type dispatchSelector interface {
+	// QueueChanged is invoked whenever the oldest request of the
+	// queue at the given index may have changed.
+	QueueChanged(idx int)
+
+	// SetQueues is invoked whenever queues are added to, or removed
+	// from the end of the queue set, the removed queues are empty.
+	SetQueues(queues []fairqueue)
+
+	// Select returns the index of the queue whose oldest request has
+	// the earliest virtual finish time. Ties are broken in round robin
+	// order, starting after the queue that was selected last, so the
+	// non-selected queues win the next time the finish times are the
+	// same. ok is false if all queues are empty.
+	Select() (idx int, ok bool)
+}
+
+// newLinearSelector returns a dispatchSelector that scans all the queues
+// on each call to Select, it costs O(number of queues) per dispatch.
+func newLinearSelector(queues []fairqueue) *linearSelector {
+	return &linearSelector{queues: queues}
+}
+
+type linearSelector struct {
+	queues     []fairqueue
+	robinIndex int
+}
+
+func (s *linearSelector) QueueChanged(int) {}
+
+func (s *linearSelector) SetQueues(queues []fairqueue) {
+	s.queues = queues
+	s.robinIndex = s.robinIndex % len(queues)
+}
+
+func (s *linearSelector) Select() (int, bool) {
+	minIndex := -1
+	minFinishR := virtual.MaxSeatSeconds
+	for range s.queues {
+		s.robinIndex = (s.robinIndex + 1) % len(s.queues)
+		oldest, ok := s.queues[s.robinIndex].Peek()
+		if !ok {
+			continue
+		}
+
+		if thisFinishR := oldest.FinishR(); thisFinishR < minFinishR {
+			minFinishR = thisFinishR
+			minIndex = s.robinIndex
+		}
+	}
+	if minIndex < 0 {
+		return 0, false
+	}
+
+	// we set the round robin indexing to start at the chosen queue
+	// for the next round.
+	s.robinIndex = minIndex
+	return minIndex, true
+}
+
+// newHeapSelector returns a dispatchSelector that maintains a min-heap
+// of the non-empty queues keyed by the virtual finish time of their
+// oldest request, it costs O(log(number of queues)) per update, and
+// O(number of queues tied at the minimum) per call to Select.
+func newHeapSelector(queues []fairqueue) *heapSelector {
+	s := &heapSelector{
+		queues: queues,
+		items:  make([]*queueItem, len(queues)),
+	}
+	for i := range queues {
+		s.items[i] = &queueItem{index: i, position: -1}
+	}
+	return s
+}
+
+type heapSelector struct {
+	queues     []fairqueue
+	items      []*queueItem
+	heap       queueHeap
+	robinIndex int
+}
+
+// queueItem is the entry in the heap for the queue at index.
+type queueItem struct {
+	index int
+	// position in the heap, -1 if the queue is empty
+	position int
+	finishR  virtual.SeatSeconds
+}
+
+func (s *heapSelector) QueueChanged(idx int) {
+	item := s.items[idx]
+	oldest, ok := s.queues[idx].Peek()
+	switch {
+	case !ok && item.position >= 0:
+		heap.Remove(&s.heap, item.position)
+	case !ok:
+	case item.position >= 0:
+		item.finishR = oldest.FinishR()
+		heap.Fix(&s.heap, item.position)
+	default:
+		item.finishR = oldest.FinishR()
+		heap.Push(&s.heap, item)
+	}
+}
+
+func (s *heapSelector) SetQueues(queues []fairqueue) {
+	for i := len(s.items); i < len(queues); i++ {
+		s.items = append(s.items, &queueItem{index: i, position: -1})
+	}
+	for i := len(queues); i < len(s.items); i++ {
+		s.items[i] = nil
+	}
+	s.items = s.items[:len(queues)]
+	s.queues = queues
+	s.robinIndex = s.robinIndex % len(queues)
+}
+
+func (s *heapSelector) Select() (int, bool) {
+	if len(s.heap) == 0 {
+		return 0, false
+	}
+
+	// walk the subtree of entries that are tied at the minimum, and
+	// pick the one closest to the last selected queue in round
+	// robin order; the children of an entry are never smaller than
+	// their parent, so we stop descending at the first larger one.
+	minFinishR := s.heap[0].finishR
+	n := len(s.queues)
+	selected, minDistance := -1, n
+	var stack [64]int
+	pending := append(stack[:0], 0)
+	for len(pending) > 0 {
+		position := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if position >= len(s.heap) || s.heap[position].finishR != minFinishR {
+			continue
+		}
+
+		idx := s.heap[position].index
+		if distance := (idx - s.robinIndex - 1 + n) % n; distance < minDistance {
+			selected, minDistance = idx, distance
+		}
+		pending = append(pending, 2*position+1, 2*position+2)
+	}
+
+	s.robinIndex = selected
+	return selected, true
+}
+
+// queueHeap implements heap.Interface
+type queueHeap []*queueItem
+
+func (h queueHeap) Len() int           { return len(h) }
+func (h queueHeap) Less(i, j int) bool { return h[i].finishR < h[j].finishR }
+func (h queueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].position = i
+	h[j].position = j
+}
+
+func (h *queueHeap) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.position = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.position = -1
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,88 @@
+package queueset
+
+import (
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+// Dump is a snapshot of the state of a queueset, the virtual times
+// are in seat-seconds.
+type Dump struct {
+	Name        string                   `json:"name"`
+	TotalSeats  uint32                   `json:"totalSeats"`
+	VirtualTime float64                  `json:"virtualTime"`
+	Requests    fairqueuing.RequestCount `json:"requests"`
+	Seats       fairqueuing.SeatCount    `json:"seats"`
+	Queues      []QueueDump              `json:"queues"`
+
+	// AdaptiveLimit is the current limit of the limiter of the
+	// queueset, it is not set if the queueset has no limiter.
+	AdaptiveLimit uint32 `json:"adaptiveLimit,omitempty"`
+}
+
+type QueueDump struct {
+	ID uint32 `json:"id"`
+	// Retired is true if the queue no longer accepts new requests
+	Retired     bool                  `json:"retired,omitempty"`
+	Length      int                   `json:"length"`
+	Seats       fairqueuing.SeatCount `json:"seats"`
+	NextFinishR float64               `json:"nextFinishR"`
+	Waiting     []RequestDump         `json:"waiting,omitempty"`
+}
+
+type RequestDump struct {
+	Request string                 `json:"request"`
+	FlowID  fairqueuing.FlowIDType `json:"flowID"`
+	Seats   uint32                 `json:"seats"`
+	StartR  float64                `json:"startR"`
+	FinishR float64                `json:"finishR"`
+	// WaitTime is how long the request has been waiting in queue
+	WaitTime time.Duration `json:"waitTime"`
+}
+
+// Dump returns the state of the queueset, and of each of its queues
+// along with the requests waiting in them, in the order of arrival.
+func (qs *queueset) Dump() Dump {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	// bring the virtual time up to the present
+	qs.vclock.Tick()
+	now := qs.clock.Now()
+	d := Dump{
+		Name:        qs.name,
+		TotalSeats:  qs.totalSeats,
+		VirtualTime: qs.vclock.RT().ToFloat(),
+		Requests:    qs.requests,
+		Seats:       qs.seats,
+		Queues:      make([]QueueDump, 0, len(qs.queues)),
+	}
+	if qs.limiter != nil {
+		d.AdaptiveLimit = qs.limiter.Limit()
+	}
+	for _, queue := range qs.queues {
+		qd := QueueDump{
+			ID:          queue.ID(),
+			Retired:     queue.Index() >= qs.nQueues,
+			Length:      queue.Length(),
+			Seats:       queue.GetWork(),
+			NextFinishR: queue.GetNextFinishR().ToFloat(),
+		}
+		queue.Walk(func(r fairqueuing.Request) bool {
+			seats, _ := r.EstimateCost()
+			startedAt, _ := r.LatencyTrackers().QueueWait.Get()
+			qd.Waiting = append(qd.Waiting, RequestDump{
+				Request:  r.String(),
+				FlowID:   r.GetFlowID(),
+				Seats:    seats,
+				StartR:   r.StartR().ToFloat(),
+				FinishR:  r.FinishR().ToFloat(),
+				WaitTime: now.Sub(startedAt),
+			})
+			return true
+		})
+		d.Queues = append(d.Queues, qd)
+	}
+	return d
+}
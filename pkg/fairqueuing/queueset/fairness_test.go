@@ -0,0 +1,100 @@
+package queueset
+
+import (
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/fairness"
+	"github.com/tkashem/apf/pkg/fairqueuing/fairness/fairnesstest"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/latencytracker"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestFairnessUnderContention(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	collector := fairness.NewCollector(clock)
+	events := &readyEvents{Collector: collector}
+	selector, err := queueselector.NewShuffleShardingQueueSelector(64, 4)
+	if err != nil {
+		t.Fatalf("failed to create queue selector: %v", err)
+	}
+	qs, err := NewQueueSet(&Config{
+		Clock: clock,
+		QueuingConfig: &QueuingConfig{
+			NQueues:        64,
+			HandSize:       4,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    1,
+		Events:        events,
+		QueueSelector: selector,
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	// the heavy flow asks for 20 seat-seconds, and the light one for
+	// 5, but there are only 10 to go around. The flow IDs are hashes,
+	// and their hands of queues do not overlap.
+	heavy, light := flowID("heavy"), flowID("light")
+	finishers := map[fairqueuing.Request]fairqueuing.Finisher{}
+	enqueue := func(id uint32, flow fairqueuing.FlowIDType) {
+		r := newRequest(id, 1, time.Second)
+		r.flowID = flow
+		r.trackers = fairqueuing.LatencyTrackers{
+			QueueWait:                 latencytracker.NewLatencyTracker(clock),
+			PostDecisionExecutionWait: latencytracker.NewLatencyTracker(clock),
+			ExecutionDuration:         latencytracker.NewLatencyTracker(clock),
+			TotalDuration:             latencytracker.NewLatencyTracker(clock),
+		}
+		finisher, err := qs.EnqueueAndDispatch(r)
+		if err != nil {
+			t.Fatalf("failed to enqueue request: %v", err)
+		}
+		finishers[r] = finisher
+	}
+	for i := 0; i < 20; i++ {
+		enqueue(uint32(i), heavy)
+	}
+	for i := 20; i < 25; i++ {
+		enqueue(uint32(i), light)
+	}
+
+	const window = 10 * time.Second
+	for start := clock.Now(); clock.Since(start) < window && len(events.ready) > 0; {
+		r := events.ready[0]
+		events.ready = events.ready[1:]
+		finishers[r].Finish(func() { clock.Step(time.Second) })
+	}
+
+	report := collector.Report(window.Seconds())
+	fairnesstest.ExpectFairShare(t, report, 0.8)
+	fairnesstest.ExpectFairness(t, report, 0.95)
+	// the requests of the heavy flow that are left over have waited
+	// for the whole window.
+	if starved := report.Starved(window); len(starved) != 1 || starved[0] != heavy {
+		t.Errorf("expected only the heavy flow to be starved, but got: %v, report: %+v", starved, report)
+	}
+}
+
+func flowID(name string) fairqueuing.FlowIDType {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return fairqueuing.FlowIDType(hash.Sum64())
+}
+
+// readyEvents keeps the requests that are dispatched, in order
+type readyEvents struct {
+	*fairness.Collector
+	ready []fairqueuing.Request
+}
+
+func (e *readyEvents) DecisionChanged(r fairqueuing.Request, d fairqueuing.DecisionType) {
+	if d == fairqueuing.DecisionExecute {
+		e.ready = append(e.ready, r)
+	}
+}
@@ -9,8 +9,10 @@ import (
 )
 
 type fairQueue struct {
-	id   uint32
-	fifo fifo
+	id uint32
+	// index of this queue in the queue set
+	index int
+	fifo  fifo
 
 	// requests is the count in the real world.
 	requests fairqueuing.RequestCount
@@ -23,6 +25,26 @@ type fairQueue struct {
 	vclock virtual.RTClock
 	// Finish time of the oldest request
 	nextFinishR virtual.SeatSeconds
+
+	// activeChanged, if set, is invoked whenever the queue becomes
+	// active, or idle, so the queue set can keep count of its active
+	// queues without walking them.
+	activeChanged func(active bool)
+}
+
+// active returns true if the queue has a request waiting or executing
+func (q *fairQueue) active() bool {
+	return q.fifo.Length() > 0 || q.seats.InUse > 0
+}
+
+// change applies the given change to the queue, and tells if it made
+// the queue active, or idle.
+func (q *fairQueue) change(fn func()) {
+	before := q.active()
+	fn()
+	if after := q.active(); after != before && q.activeChanged != nil {
+		q.activeChanged(after)
+	}
 }
 
 func (q *fairQueue) GetNextFinishR() virtual.SeatSeconds {
@@ -33,16 +55,23 @@ func (q *fairQueue) ID() uint32 {
 	return q.id
 }
 
+func (q *fairQueue) Index() int {
+	return q.index
+}
+
 func (q *fairQueue) String() string {
 	return fmt.Sprintf("%d", q.id)
 }
 
 func (q *fairQueue) Enqueue(r fairqueuing.Request) (disposer, disposer, error) {
-	if q.fifo.Length() == 0 && q.seats.InUse == 0 {
+	if !q.active() {
 		q.nextFinishR = virtual.MinSeatSeconds
 	}
 
-	disposer := q.fifo.Enqueue(r)
+	var disposer disposer
+	q.change(func() {
+		disposer = q.fifo.Enqueue(r)
+	})
 	seats, width := r.EstimateCost()
 
 	q.seats.Waiting += seats
@@ -56,11 +85,14 @@ func (q *fairQueue) Enqueue(r fairqueuing.Request) (disposer, disposer, error) {
 	r.OnStart(rt, startR, finishR)
 
 	postExecution := disposerFunc(func() {
-		q.seats.InUse -= seats
+		q.change(func() {
+			q.seats.InUse -= seats
+		})
 		q.requests.Executing -= 1
+		q.adjustWork(r)
 	})
 	postTimeout := disposerFunc(func() {
-		disposer.Dispose()
+		q.change(disposer.Dispose)
 		q.seats.Waiting -= seats
 		q.requests.Waiting -= 1
 	})
@@ -68,7 +100,11 @@ func (q *fairQueue) Enqueue(r fairqueuing.Request) (disposer, disposer, error) {
 }
 
 func (q *fairQueue) Dequeue() (fairqueuing.Request, disposer, bool) {
-	request, ok := q.fifo.Dequeue()
+	var request fairqueuing.Request
+	var ok bool
+	q.change(func() {
+		request, ok = q.fifo.Dequeue()
+	})
 	if !ok {
 		return nil, nil, false
 	}
@@ -79,7 +115,9 @@ func (q *fairQueue) Dequeue() (fairqueuing.Request, disposer, bool) {
 
 	// before execution begins
 	preExecution := disposerFunc(func() {
-		q.seats.InUse += seats
+		q.change(func() {
+			q.seats.InUse += seats
+		})
 		q.requests.Executing += 1
 	})
 	return request, preExecution, true
@@ -89,6 +127,10 @@ func (q *fairQueue) Peek() (fairqueuing.Request, bool) {
 	return q.fifo.Peek()
 }
 
+func (q *fairQueue) Walk(f walkFunc) {
+	q.fifo.Walk(f)
+}
+
 func (q *fairQueue) Length() int {
 	return q.fifo.Length()
 }
@@ -96,3 +138,38 @@ func (q *fairQueue) Length() int {
 func (q *fairQueue) GetWork() fairqueuing.SeatCount {
 	return q.seats
 }
+
+// adjustWork replaces the estimated work of the given request, which
+// has finished executing, with the seat-seconds it actually took: the
+// requests waiting behind it, and those yet to arrive, are shifted in
+// virtual time by the difference, so a flow that under-estimates its
+// requests pays for the overrun, and one that over-estimates gets back
+// what it did not use.
+func (q *fairQueue) adjustWork(r fairqueuing.Request) {
+	seats, width := r.EstimateCost()
+	_, execution := r.LatencyTrackers().ExecutionDuration.Get()
+	actual := virtual.SeatsTimesDuration(float64(seats), execution)
+	if worker, ok := r.(fairqueuing.AdditionalWorker); ok {
+		// the additional work is charged as estimated, it is not
+		// done while the request occupies its seats.
+		actual += worker.AdditionalWork()
+	}
+	if actual == width {
+		return
+	}
+
+	shift := func(R virtual.SeatSeconds) virtual.SeatSeconds {
+		if actual > width {
+			return R + (actual - width)
+		}
+		if R < width-actual {
+			return virtual.MinSeatSeconds
+		}
+		return R - (width - actual)
+	}
+	q.fifo.Walk(func(waiting fairqueuing.Request) bool {
+		waiting.OnStart(waiting.ArrivalR(), shift(waiting.StartR()), shift(waiting.FinishR()))
+		return true
+	})
+	q.nextFinishR = shift(q.nextFinishR)
+}
@@ -1,47 +1,66 @@
 package queueset
 
 import (
+	"sync"
+	"time"
+
 	"github.com/tkashem/apf/pkg/fairqueuing"
 )
 
+// queuedFinisher finishes a request that has been enqueued, Finish may
+// be invoked more than once, and from any goroutine: only the first
+// invocation waits for the decision and executes the request, the
+// others wait for it to complete.
 type queuedFinisher struct {
 	request                    fairqueuing.Request
 	postTimeout, postExecution disposer
-	finished                   bool
+	once                       sync.Once
+
+	// retryAfter is set, under the queue set lock, once the request is
+	// removed from its queue after it has been rejected.
+	retryAfter time.Duration
+}
+
+// RetryAfter returns how long the request, if it has been rejected
+// while waiting in queue, should wait before it is retried; it is only
+// meaningful once Finish has returned.
+func (r *queuedFinisher) RetryAfter() time.Duration {
+	return r.retryAfter
 }
 
 func (r *queuedFinisher) Finish(fn func()) {
-	if r.finished {
-		return
-	}
-	r.finished = true
+	r.once.Do(func() {
+		r.finish(fn)
+	})
+}
+
+func (r *queuedFinisher) finish(fn func()) {
 	trackers := r.request.LatencyTrackers()
 
 	decision := r.request.WaitForDecision()
 	switch decision {
-	case fairqueuing.DecisionTimeout:
-		// the request had timed out while in the queue
+	case fairqueuing.DecisionReject:
+		// the request had been rejected while in the queue
 		func() {
-			defer trackers.TotalDuration.Finish()
-			r.postTimeout.Dispose()
+			defer r.postTimeout.Dispose()
+			trackers.TotalDuration.Finish()
 		}()
 
 	case fairqueuing.DecisionExecute:
 		// the request has been dequeued and scheduled for execution
 		// execute the request handler
 		func() {
+			// the total duration is finished before the request is
+			// disposed of, so the events can observe it.
+			defer r.postExecution.Dispose()
 			defer trackers.TotalDuration.Finish()
 
 			trackers.PostDecisionExecutionWait.Finish()
 			func() {
-				defer r.postExecution.Dispose()
-				func() {
-					trackers.ExecutionDuration.Start()
-					defer trackers.ExecutionDuration.Finish()
-					fn()
-				}()
+				trackers.ExecutionDuration.Start()
+				defer trackers.ExecutionDuration.Finish()
+				fn()
 			}()
-
 		}()
 
 	default:
@@ -0,0 +1,120 @@
+package queueset
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/promise"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+
+	"k8s.io/utils/clock"
+)
+
+// TestFinishUnderContention races the dispatching of the requests with
+// their queue wait contexts, and with each other's Finish, it is meant
+// to be run with -race.
+func TestFinishUnderContention(t *testing.T) {
+	counter := &countingEvents{}
+	qs, err := NewQueueSet(&Config{
+		Clock: clock.RealClock{},
+		QueuingConfig: &QueuingConfig{
+			NQueues:        8,
+			QueueMaxLength: 64,
+		},
+		TotalSeats:    4,
+		Events:        counter,
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	const total = 4000
+	var accepted, executed, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// some of the requests are canceled right away, the others
+			// time out sooner or later.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rand.Intn(2000))*time.Microsecond)
+			defer cancel()
+			if i%10 == 0 {
+				cancel()
+			}
+			r := newRequest(uint32(i), uint32(1+rand.Intn(2)), time.Millisecond)
+			r.ctx = ctx
+			r.DecisionWaiterSetter = promise.New(ctx)
+
+			finisher, err := qs.EnqueueAndDispatch(r)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+
+			// the request is finished from two goroutines at once, it
+			// should be executed at most once.
+			var executions int64
+			var finishers sync.WaitGroup
+			for j := 0; j < 2; j++ {
+				finishers.Add(1)
+				go func() {
+					defer finishers.Done()
+					finisher.Finish(func() {
+						atomic.AddInt64(&executions, 1)
+						time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+					})
+				}()
+			}
+			finishers.Wait()
+
+			switch decision := r.WaitForDecision(); {
+			case decision == fairqueuing.DecisionExecute && executions == 1:
+				atomic.AddInt64(&executed, 1)
+			case decision == fairqueuing.DecisionReject && executions == 0:
+				atomic.AddInt64(&rejected, 1)
+			default:
+				t.Errorf("request %d: decision %d, but executed %d times", i, decision, executions)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if executed+rejected != accepted {
+		t.Errorf("expected the %d accepted requests to be executed or rejected, but got: %d executed, %d rejected", accepted, executed, rejected)
+	}
+	if executed == 0 || rejected == 0 {
+		t.Errorf("expected some requests to be executed, and some to time out, but got: %d executed, %d rejected", executed, rejected)
+	}
+	if disposed := atomic.LoadInt64(&counter.disposed); disposed != executed {
+		t.Errorf("expected %d requests to be disposed of, but got: %d", executed, disposed)
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	if qs.requests != (fairqueuing.RequestCount{}) || qs.seats != (fairqueuing.SeatCount{}) {
+		t.Errorf("expected no request to be accounted for, but got: %+v, %+v", qs.requests, qs.seats)
+	}
+	for _, queue := range qs.queues {
+		if queue.Length() != 0 || queue.GetWork() != (fairqueuing.SeatCount{}) {
+			t.Errorf("expected queue %s to be empty, but got length: %d, seats: %+v", queue, queue.Length(), queue.GetWork())
+		}
+	}
+	if len(qs.evictors) != 0 {
+		t.Errorf("expected no request to be waiting, but got: %d", len(qs.evictors))
+	}
+}
+
+type countingEvents struct {
+	noopEvents
+	disposed int64
+}
+
+func (e *countingEvents) Disposed(fairqueuing.Request) { atomic.AddInt64(&e.disposed, 1) }
@@ -0,0 +1,254 @@
+package queueset
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+// Limiter adapts the number of seats a queueset may occupy to the
+// latency of the requests it executes, the limit of the queueset is
+// the lesser of its total seats and the limit of its Limiter.
+//
+// A Limiter is only accessed with the lock of its queueset held.
+type Limiter interface {
+	// Observe is invoked when a request finishes executing, latency is
+	// its execution duration, and inUse the number of seats that were
+	// in use when it finished, its own included.
+	Observe(latency time.Duration, inUse uint32)
+
+	// Limit returns the current number of seats
+	Limit() uint32
+}
+
+// LimitEvents is implemented by the Events of a queueset that want to
+// know the limit of its Limiter, LimitChanged is invoked with the
+// initial limit, every time the limit changes, and with 0 if the
+// Limiter is removed.
+type LimitEvents interface {
+	LimitChanged(limit uint32)
+}
+
+// LimiterBounds are the bounds within which a Limiter adjusts its
+// limit, it starts at Initial, or at Max if Initial is not specified.
+type LimiterBounds struct {
+	Min, Max, Initial uint32
+}
+
+func (b LimiterBounds) validate() error {
+	if b.Min < 1 {
+		return fmt.Errorf("the minimum limit must be positive")
+	}
+	if b.Max < b.Min {
+		return fmt.Errorf("the maximum limit %d must not be less than the minimum %d", b.Max, b.Min)
+	}
+	if b.Initial != 0 && (b.Initial < b.Min || b.Initial > b.Max) {
+		return fmt.Errorf("the initial limit %d must be in the range [%d, %d]", b.Initial, b.Min, b.Max)
+	}
+	return nil
+}
+
+func (b LimiterBounds) initial() float64 {
+	if b.Initial != 0 {
+		return float64(b.Initial)
+	}
+	return float64(b.Max)
+}
+
+func (b LimiterBounds) clamp(limit float64) float64 {
+	return math.Max(float64(b.Min), math.Min(float64(b.Max), limit))
+}
+
+// AIMDConfig configures a limiter that increases the limit additively,
+// and decreases it multiplicatively.
+type AIMDConfig struct {
+	LimiterBounds
+
+	// LatencyThreshold is the execution duration beyond which the
+	// backend is taken to be overloaded.
+	LatencyThreshold time.Duration
+
+	// BackoffRatio, in the range (0, 1), is what the limit is
+	// multiplied by when a request exceeds the latency threshold, it
+	// defaults to 0.9.
+	BackoffRatio float64
+}
+
+// NewAIMDLimiter returns a Limiter that backs off whenever a request
+// takes longer than the latency threshold to execute, and otherwise
+// grows the limit by a seat for each request that finishes while at
+// least half of the limit is in use.
+func NewAIMDLimiter(config AIMDConfig) (*aimdLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.LatencyThreshold <= 0 {
+		return nil, fmt.Errorf("the latency threshold must be positive")
+	}
+	ratio := config.BackoffRatio
+	if ratio == 0 {
+		ratio = 0.9
+	}
+	if ratio <= 0 || ratio >= 1 {
+		return nil, fmt.Errorf("the backoff ratio must be in the range (0, 1)")
+	}
+	return &aimdLimiter{bounds: config.LimiterBounds, threshold: config.LatencyThreshold, ratio: ratio, limit: config.initial()}, nil
+}
+
+type aimdLimiter struct {
+	bounds    LimiterBounds
+	threshold time.Duration
+	ratio     float64
+	limit     float64
+}
+
+func (l *aimdLimiter) Observe(latency time.Duration, inUse uint32) {
+	switch {
+	case latency > l.threshold:
+		l.limit = l.bounds.clamp(math.Floor(l.limit * l.ratio))
+	case 2*float64(inUse) >= l.limit:
+		// the limit is only grown while it is being used, a queueset
+		// that is mostly idle tells nothing about the capacity.
+		l.limit = l.bounds.clamp(l.limit + 1)
+	}
+}
+
+func (l *aimdLimiter) Limit() uint32 {
+	return uint32(l.limit)
+}
+
+// GradientConfig configures a limiter that follows the gradient of the
+// latency.
+type GradientConfig struct {
+	LimiterBounds
+
+	// Tolerance, at least 1, is how much the latency may grow over
+	// its long term average before the limit is reduced, it defaults
+	// to 1.5.
+	Tolerance float64
+
+	// Smoothing, in the range (0, 1], is the weight of each new
+	// estimate of the limit, it defaults to 0.2.
+	Smoothing float64
+
+	// Window is the number of requests the long term average latency
+	// is taken over, it defaults to 600.
+	Window int
+}
+
+// NewGradientLimiter returns a Limiter that compares the latency of
+// each request to the long term average: the limit is reduced as the
+// latency grows beyond the tolerance, and it is grown by the square
+// root of the limit otherwise, so the backend always has some queue
+// to work through.
+func NewGradientLimiter(config GradientConfig) (*gradientLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	l := &gradientLimiter{bounds: config.LimiterBounds, tolerance: 1.5, smoothing: 0.2, window: 600, limit: config.initial()}
+	if config.Tolerance != 0 {
+		l.tolerance = config.Tolerance
+	}
+	if config.Smoothing != 0 {
+		l.smoothing = config.Smoothing
+	}
+	if config.Window != 0 {
+		l.window = config.Window
+	}
+
+	switch {
+	case l.tolerance < 1:
+		return nil, fmt.Errorf("the tolerance must be at least 1")
+	case l.smoothing <= 0 || l.smoothing > 1:
+		return nil, fmt.Errorf("the smoothing must be in the range (0, 1]")
+	case l.window < 1:
+		return nil, fmt.Errorf("the window must be positive")
+	}
+	return l, nil
+}
+
+type gradientLimiter struct {
+	bounds    LimiterBounds
+	tolerance float64
+	smoothing float64
+	window    int
+	limit     float64
+
+	// longTerm is the exponential moving average of the latency, in
+	// seconds, and samples the number of latencies observed so far
+	longTerm float64
+	samples  int
+}
+
+func (l *gradientLimiter) Observe(latency time.Duration, inUse uint32) {
+	shortTerm := latency.Seconds()
+	if shortTerm <= 0 {
+		return
+	}
+
+	// the average is taken over the samples seen so far until the
+	// window fills up.
+	if l.samples < l.window {
+		l.samples++
+	}
+	l.longTerm += (shortTerm - l.longTerm) / float64(l.samples)
+
+	if 2*float64(inUse) < l.limit {
+		return
+	}
+	gradient := math.Max(0.5, math.Min(1, l.tolerance*l.longTerm/shortTerm))
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.bounds.clamp(l.limit*(1-l.smoothing) + estimate*l.smoothing)
+}
+
+func (l *gradientLimiter) Limit() uint32 {
+	return uint32(l.limit)
+}
+
+// seatLimitLocked returns the number of seats the queueset may occupy
+func (qs *queueset) seatLimitLocked() uint32 {
+	if qs.limiter == nil {
+		return qs.totalSeats
+	}
+	if limit := qs.limiter.Limit(); limit < qs.totalSeats {
+		return limit
+	}
+	return qs.totalSeats
+}
+
+func (qs *queueset) setLimiterLocked(limiter Limiter) {
+	if limiter == nil && qs.limiter == nil {
+		return
+	}
+	qs.limiter = limiter
+
+	var limit uint32
+	if limiter != nil {
+		limit = limiter.Limit()
+	}
+	qs.limitChangedLocked(limit)
+}
+
+// observeLocked feeds the execution duration of the given request to
+// the limiter, before its seats are released.
+func (qs *queueset) observeLocked(r fairqueuing.Request) {
+	if qs.limiter == nil {
+		return
+	}
+	before := qs.limiter.Limit()
+	_, latency := r.LatencyTrackers().ExecutionDuration.Get()
+	qs.limiter.Observe(latency, qs.seats.InUse)
+	if limit := qs.limiter.Limit(); limit != before {
+		qs.limitChangedLocked(limit)
+	}
+}
+
+// limitChangedLocked tells the events about the new limit of the
+// limiter, it is 0 if the limiter has been removed.
+func (qs *queueset) limitChangedLocked(limit uint32) {
+	if events, ok := qs.events.(LimitEvents); ok {
+		events.LimitChanged(limit)
+	}
+}
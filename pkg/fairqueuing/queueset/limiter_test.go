@@ -0,0 +1,166 @@
+package queueset
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/latencytracker"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	l, err := NewAIMDLimiter(AIMDConfig{
+		LimiterBounds:    LimiterBounds{Min: 2, Max: 10, Initial: 5},
+		LatencyThreshold: time.Second,
+		BackoffRatio:     0.5,
+	})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+
+	steps := []struct {
+		latency time.Duration
+		inUse   uint32
+		want    uint32
+	}{
+		// the limit does not grow while most of it is unused
+		{latency: 100 * time.Millisecond, inUse: 1, want: 5},
+		{latency: 100 * time.Millisecond, inUse: 3, want: 6},
+		{latency: 100 * time.Millisecond, inUse: 6, want: 7},
+		{latency: 2 * time.Second, inUse: 7, want: 3},
+		{latency: 2 * time.Second, inUse: 3, want: 2},
+	}
+	for i, step := range steps {
+		l.Observe(step.latency, step.inUse)
+		if got := l.Limit(); got != step.want {
+			t.Errorf("step %d: expected a limit of %d, but got: %d", i, step.want, got)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		l.Observe(time.Millisecond, 10)
+	}
+	if got := l.Limit(); got != 10 {
+		t.Errorf("expected the limit to stop at the maximum, but got: %d", got)
+	}
+
+	if _, err := NewAIMDLimiter(AIMDConfig{LimiterBounds: LimiterBounds{Min: 2, Max: 1}, LatencyThreshold: time.Second}); err == nil {
+		t.Errorf("expected an error for a maximum less than the minimum")
+	}
+}
+
+func TestGradientLimiter(t *testing.T) {
+	l, err := NewGradientLimiter(GradientConfig{LimiterBounds: LimiterBounds{Min: 4, Max: 100, Initial: 20}})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		l.Observe(100*time.Millisecond, l.Limit())
+	}
+	steady := l.Limit()
+	if steady <= 20 {
+		t.Errorf("expected the limit to grow while the latency is steady, but got: %d", steady)
+	}
+
+	for i := 0; i < 50; i++ {
+		l.Observe(time.Second, l.Limit())
+	}
+	if got := l.Limit(); got >= steady {
+		t.Errorf("expected the limit to shrink below %d as the latency grows, but got: %d", steady, got)
+	}
+
+	for i := 0; i < 1000; i++ {
+		l.Observe(10*time.Second, l.Limit())
+	}
+	if got := l.Limit(); got < 4 {
+		t.Errorf("expected the limit not to go below the minimum, but got: %d", got)
+	}
+}
+
+func TestQueueSetFollowsTheLimiter(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	limiter, err := NewAIMDLimiter(AIMDConfig{
+		LimiterBounds:    LimiterBounds{Min: 1, Max: 4},
+		LatencyThreshold: time.Second,
+		BackoffRatio:     0.5,
+	})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+	events := &limitEvents{}
+	qs, err := NewQueueSet(&Config{
+		Clock: clock,
+		QueuingConfig: &QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    4,
+		Events:        events,
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+		Limiter:       limiter,
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	var finishers []fairqueuing.Finisher
+	for i := 0; i < 8; i++ {
+		r := newRequest(uint32(i), 1, time.Second)
+		r.trackers.ExecutionDuration = latencytracker.NewLatencyTracker(clock)
+		finisher, err := qs.EnqueueAndDispatch(r)
+		if err != nil {
+			t.Fatalf("failed to enqueue request: %v", err)
+		}
+		finishers = append(finishers, finisher)
+	}
+	if want := (fairqueuing.RequestCount{Executing: 4, Waiting: 4}); qs.requests != want {
+		t.Fatalf("expected request count: %+v, but got: %+v", want, qs.requests)
+	}
+
+	// a slow request halves the limit, the seats it releases are not
+	// taken by the requests that are waiting.
+	finishers[0].Finish(func() { clock.Step(2 * time.Second) })
+	if want := (fairqueuing.RequestCount{Executing: 3, Waiting: 4}); qs.requests != want {
+		t.Errorf("expected request count: %+v, but got: %+v", want, qs.requests)
+	}
+	if d := qs.Dump(); d.AdaptiveLimit != 2 {
+		t.Errorf("expected an adaptive limit of 2 in the dump, but got: %d", d.AdaptiveLimit)
+	}
+	if want := []uint32{4, 2}; !equal(events.limits, want) {
+		t.Errorf("expected the limits: %v, but got: %v", want, events.limits)
+	}
+
+	// a fast request grows the limit by a seat, the executing requests
+	// have drained to two, so one more is dispatched.
+	finishers[1].Finish(func() {})
+	if want := (fairqueuing.RequestCount{Executing: 3, Waiting: 3}); qs.requests != want {
+		t.Errorf("expected request count: %+v, but got: %+v", want, qs.requests)
+	}
+	if want := []uint32{4, 2, 3}; !equal(events.limits, want) {
+		t.Errorf("expected the limits: %v, but got: %v", want, events.limits)
+	}
+}
+
+type limitEvents struct {
+	noopEvents
+	limits []uint32
+}
+
+func (e *limitEvents) LimitChanged(limit uint32) {
+	e.limits = append(e.limits, limit)
+}
+
+func equal(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
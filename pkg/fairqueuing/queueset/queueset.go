@@ -14,31 +14,31 @@ var (
 	accommodationErr = fmt.Errorf("cannot accommodate request")
 	queueEmptyErr    = fmt.Errorf("selected queue should not be empty")
 	enqueueErr       = fmt.Errorf("failed to enqueue the request")
+	decisionErr      = fmt.Errorf("failed to set a decision for the request")
 )
 
 func NewQueueSet(config *Config) (*queueset, error) {
-	if config.TotalSeats < 1 {
-		return nil, fmt.Errorf("seats must be positive")
+	if err := Validate(config); err != nil {
+		return nil, err
 	}
 
-	qs := &queueset{clock: config.Clock}
+	qs := &queueset{name: config.Name, clock: config.Clock, evictors: map[fairqueuing.Request]*evictor{}}
 	vclock := virtual.NewRTClock(qs.clock, qs.getWorkLocked)
 	qs.vclock = vclock
 
 	queues := make([]fairqueue, config.QueuingConfig.NQueues)
 	for i := range queues {
-		queues[i] = &fairQueue{
-			id:     uint32(i + 1),
-			fifo:   NewFIFO(),
-			vclock: vclock,
-		}
+		queues[i] = qs.newQueue(i)
 	}
 	qs.queues = queues
+	qs.nQueues = len(queues)
+	qs.selector = newHeapSelector(queues)
 	qs.assigner = config.QueueSelector
 
 	qs.totalSeats = config.TotalSeats
 	qs.queueMaxLength = config.QueuingConfig.QueueMaxLength
 	qs.events = config.Events
+	qs.setLimiterLocked(config.Limiter)
 	return qs, nil
 }
 
@@ -47,7 +47,10 @@ type Counter struct {
 	Waiting   uint32
 }
 
+var _ fairqueuing.FairQueueSet = &queueset{}
+
 type queueset struct {
+	name       string
 	lock       sync.Mutex
 	totalSeats uint32
 
@@ -58,28 +61,85 @@ type queueset struct {
 	// by all the requests that are currently executing in this queue,
 	// or waiting to be executed
 	seats fairqueuing.SeatCount
+	// seatDemandHighWatermark is the highest number of seats occupied
+	// or waited for since the last call to ResetSeatDemand
+	seatDemandHighWatermark uint32
 
 	queueMaxLength int
-	queues         []fairqueue
-	robinIndex     int
-	events         Events
-	clock          clock.Clock
-	vclock         virtual.RTClock
-	assigner       fairqueuing.QueueSelector
+	// queues beyond the first nQueues are retired, new requests are
+	// not assigned to them, and they are removed once they drain.
+	queues  []fairqueue
+	nQueues int
+	// activeQueues is the number of queues with a request waiting or
+	// executing.
+	activeQueues int
+	selector     dispatchSelector
+	events       Events
+	clock        clock.Clock
+	vclock       virtual.RTClock
+	assigner     fairqueuing.QueueSelector
+	limiter      Limiter
+	// evictors holds the requests that are waiting in queue, each
+	// with the function that removes it from its queue once it has
+	// been rejected.
+	evictors map[fairqueuing.Request]*evictor
+
+	// shuttingDown is set once Shutdown is called, new requests are
+	// rejected from then on, and dispatchStopped is set if the waiting
+	// requests are rejected before they could be dispatched.
+	shuttingDown    bool
+	dispatchStopped bool
+	// inflight tracks the requests that have been accepted, and whose
+	// Finish has not completed yet.
+	inflight sync.WaitGroup
 }
 
 func (qs *queueset) Name() string {
-	return ""
+	return qs.name
 }
 
 func (qs *queueset) TotalQueues() int {
-	return len(qs.queues)
+	return qs.nQueues
 }
 
 func (qs *queueset) GetFairQueue(idx int) fairqueuing.FairQueue {
 	return qs.queues[idx]
 }
 
+// TotalSeats returns the number of seats the queueset may
+// currently occupy.
+func (qs *queueset) TotalSeats() uint32 {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	return qs.totalSeats
+}
+
+// SetTotalSeats changes the number of seats the queueset may occupy,
+// the requests already executing are not affected if the number of
+// seats shrinks, and if it grows the waiting requests are dispatched
+// to the newly available seats right away.
+func (qs *queueset) SetTotalSeats(seats uint32) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	qs.vclock.Tick()
+	qs.totalSeats = seats
+	qs.dispatchAsMuchAsPossibleLocked()
+}
+
+// ResetSeatDemand returns the highest number of seats occupied or
+// waited for by requests since the last call, and starts a new
+// observation period.
+func (qs *queueset) ResetSeatDemand() uint32 {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	highWatermark := qs.seatDemandHighWatermark
+	qs.seatDemandHighWatermark = qs.seats.Total()
+	return highWatermark
+}
+
 func (qs *queueset) EnqueueAndDispatch(r fairqueuing.Request) (fairqueuing.Finisher, error) {
 	qs.lock.Lock()
 	defer qs.lock.Unlock()
@@ -88,7 +148,7 @@ func (qs *queueset) EnqueueAndDispatch(r fairqueuing.Request) (fairqueuing.Finis
 	if err != nil {
 		return nil, err
 	}
-	qs.dispatch()
+	qs.dispatchAsMuchAsPossibleLocked()
 	return finisher, nil
 }
 
@@ -99,17 +159,26 @@ func (qs *queueset) Dispatch() (bool, error) {
 	return qs.dispatch()
 }
 
-func (qs *queueset) Enqueue(r fairqueuing.Request) (*queuedFinisher, error) {
+func (qs *queueset) Enqueue(r fairqueuing.Request) (fairqueuing.Finisher, error) {
 	qs.lock.Lock()
 	defer qs.lock.Unlock()
 
-	return qs.enqueue(r)
+	finisher, err := qs.enqueue(r)
+	if err != nil {
+		return nil, err
+	}
+	return finisher, nil
 }
 
 func (qs *queueset) enqueue(r fairqueuing.Request) (*queuedFinisher, error) {
 	trackers := r.LatencyTrackers()
 	trackers.TotalDuration.Start()
 
+	if qs.shuttingDown {
+		qs.events.Rejected(r, fairqueuing.RejectShuttingDown)
+		return nil, &fairqueuing.RejectedError{Reason: fairqueuing.RejectShuttingDown}
+	}
+
 	selected, err := qs.assigner.SelectQueue(qs, r.GetFlowID())
 	if err != nil {
 		return nil, fmt.Errorf("error assigning queue - %v", err)
@@ -119,102 +188,167 @@ func (qs *queueset) enqueue(r fairqueuing.Request) (*queuedFinisher, error) {
 	qs.events.QueueSelected(queue, r)
 
 	// can we fit the request?
-	if qs.seats.InUse >= qs.totalSeats && queue.Length() >= qs.queueMaxLength {
-		return nil, accommodationErr
+	if qs.seats.InUse >= qs.seatLimitLocked() && queue.Length() >= qs.queueMaxLength {
+		reason := fairqueuing.RejectQueueFull
+		if qs.queueMaxLength == 0 {
+			reason = fairqueuing.RejectConcurrencyLimit
+		}
+		qs.events.Rejected(r, reason)
+		return nil, &fairqueuing.RejectedError{Reason: reason, RetryAfter: qs.retryAfterLocked(queue)}
 	}
 
+	// advance the virtual time before the queue set changes state so
+	// that the request arrives at the present R.
+	qs.vclock.Tick()
+	if qs.exceedsWaitBudgetLocked(queue, r) {
+		// the request would only be parked in its queue to time out
+		qs.events.Rejected(r, fairqueuing.RejectWaitBudgetExceeded)
+		return nil, &fairqueuing.RejectedError{Reason: fairqueuing.RejectWaitBudgetExceeded, RetryAfter: qs.retryAfterLocked(queue)}
+	}
 	queuePostExecution, queuePostTimeout, err := queue.Enqueue(r)
 	if err != nil {
 		return nil, enqueueErr
 	}
+	qs.selector.QueueChanged(queue.Index())
 	trackers.QueueWait.Start()
+	qs.inflight.Add(1)
 
-	qs.vclock.Tick()
 	seats, _ := r.EstimateCost()
 	qs.seats.Waiting += seats
 	qs.requests.Waiting += 1
+	if demand := qs.seats.Total(); demand > qs.seatDemandHighWatermark {
+		qs.seatDemandHighWatermark = demand
+	}
 
 	qs.events.Enqueued(queue, r)
+	finisher := &queuedFinisher{request: r}
+
+	// removeLocked removes the request from its queue once it has been
+	// rejected while waiting, it does nothing if the request has been
+	// removed already, or dispatched.
+	removeLocked := func() {
+		if !qs.stopWaitingLocked(r) {
+			return
+		}
+		qs.vclock.Tick()
+		queuePostTimeout.Dispose()
+		qs.selector.QueueChanged(queue.Index())
+		finisher.retryAfter = qs.retryAfterLocked(queue)
+		qs.timeoutLocked(r)
+		qs.events.Rejected(r, r.RejectReason())
+	}
+	stopCh := make(chan struct{})
+	qs.evictors[r] = &evictor{removeLocked: removeLocked, stopCh: stopCh}
+
+	// the request is evicted from its queue as soon as its queue wait
+	// context is done, so it does not hold on to its place until its
+	// Finish is called. The watch ends once the request is no longer
+	// waiting, so a request that is dispatched, or rejected otherwise,
+	// does not hold on to a goroutine for as long as its context lives.
+	if done := r.Context().Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+			case <-stopCh:
+				return
+			}
+			qs.lock.Lock()
+			defer qs.lock.Unlock()
+
+			r.Reject(fairqueuing.QueueWaitRejectReason(r.Context().Err()))
+			if r.RejectReason() != fairqueuing.RejectReasonNone {
+				removeLocked()
+			}
+		}()
+	}
 
 	// if a request has been executed, that means the Dispatch method
 	// had already dequeued, and scheduled it for execution, in this
 	// case we no longer need to remove it from the queue.
 	postExecution := disposerFunc(func() {
+		defer qs.inflight.Done()
 		defer qs.events.Disposed(r)
 		func() {
 			qs.lock.Lock()
 			defer qs.lock.Unlock()
 
+			qs.vclock.Tick()
+			// the finish times of the requests waiting in the queue
+			// are adjusted to the actual work of this request.
 			queuePostExecution.Dispose()
+			qs.selector.QueueChanged(queue.Index())
 			qs.finishLocked(r)
 		}()
 	})
 
 	postTimeout := disposerFunc(func() {
-		// if a request has timed out while waiting to be executed, that
-		// means the Dispatch method had not had a successful attempt to
-		// schedule it for execution, and thus it remains in the queue, so
-		// we should remove it from its queue.
-		defer qs.events.Timeout(r)
-		func() {
-			qs.lock.Lock()
-			defer qs.lock.Unlock()
-
-			queuePostTimeout.Dispose()
-			qs.timeoutLocked(r)
-		}()
+		// if a request has been rejected while waiting to be executed,
+		// that means the Dispatch method had not had a successful attempt
+		// to schedule it for execution, and thus it remains in the queue,
+		// unless it has been evicted already.
+		defer qs.inflight.Done()
+
+		qs.lock.Lock()
+		defer qs.lock.Unlock()
+		removeLocked()
 	})
 
 	// cleanup after execution
-	return &queuedFinisher{request: r, postExecution: postExecution, postTimeout: postTimeout}, nil
+	finisher.postExecution, finisher.postTimeout = postExecution, postTimeout
+	return finisher, nil
 }
 
 func (qs *queueset) dispatch() (bool, error) {
-	var minQueue fairqueue
-	var minIndex int
-	var minRequest fairqueuing.Request
-	minFinishR := virtual.MaxSeatSeconds
-	for range qs.queues {
-		qs.robinIndex = (qs.robinIndex + 1) % len(qs.queues)
-		queue := qs.queues[qs.robinIndex]
-		oldest, ok := queue.Peek()
-		if !ok {
-			continue
-		}
-
-		thisFinishR := oldest.FinishR()
-		if thisFinishR < minFinishR {
-			minFinishR = thisFinishR
-			minQueue = queue
-			minRequest = oldest
-		}
+	if qs.dispatchStopped {
+		return false, nil
 	}
-	if minQueue == nil || minRequest == nil {
+	minIndex, ok := qs.selector.Select()
+	if !ok {
 		return false, nil
 	}
-
-	// we set the round robin indexing to start at the chose queue
-	// for the next round.  This way the non-selected queues
-	// win in the case that the virtual finish times are the same
-	qs.robinIndex = minIndex
+	minQueue := qs.queues[minIndex]
+	minRequest, ok := minQueue.Peek()
+	if !ok {
+		// we should never be here
+		return false, queueEmptyErr
+	}
 
 	trackers := minRequest.LatencyTrackers()
 	seats, _ := minRequest.EstimateCost()
 	if qs.seats.InUse+seats > qs.totalSeats {
 		return false, accommodationErr
 	}
+	// a request that is wider than the limit of the limiter is
+	// dispatched once nothing else executes, so it does not wait
+	// forever.
+	if qs.seats.InUse > 0 && qs.seats.InUse+seats > qs.seatLimitLocked() {
+		return false, accommodationErr
+	}
 
+	// the decision is made before the request leaves its queue, both
+	// under the lock, so a request that has been rejected while
+	// waiting, by its queue wait context for example, is evicted
+	// instead of being accounted for as executing. The handler may
+	// start executing the request as soon as the decision is made, so
+	// we start tracking the latency until it does before.
+	trackers.PostDecisionExecutionWait.Start()
+	if ok := minRequest.SetDecision(fairqueuing.DecisionExecute); !ok {
+		qs.evictors[minRequest].removeLocked()
+		return false, decisionErr
+	}
+	qs.stopWaitingLocked(minRequest)
+
+	qs.vclock.Tick()
 	_, queuePreExecution, ok := minQueue.Dequeue()
 	if !ok {
 		// we should never be here
 		return false, queueEmptyErr
 	}
+	qs.selector.QueueChanged(minIndex)
 
-	// do the things necessary before the decision is set
 	func() {
 		defer qs.events.Dequeued(minQueue, minRequest)
 
-		qs.vclock.Tick()
 		qs.requests.Waiting -= 1
 		qs.seats.Waiting -= seats
 
@@ -227,38 +361,68 @@ func (qs *queueset) dispatch() (bool, error) {
 		trackers.QueueWait.Finish()
 	}()
 
-	if ok := minRequest.SetDecision(fairqueuing.DecisionExecute); !ok {
-		return false, fmt.Errorf("failed to set  a decision for the request")
-	}
-
 	func() {
 		defer qs.events.DecisionChanged(minRequest, fairqueuing.DecisionExecute)
 
 		queuePreExecution.Dispose()
 		qs.requests.Executing += 1
 		qs.seats.InUse += seats
-
-		// we have just made a decision to execute the request, we want
-		// to track the latency from here until the user handler starts
-		// executing.
-		trackers.PostDecisionExecutionWait.Start()
 	}()
 	return true, nil
 }
 
+// dispatchAsMuchAsPossibleLocked keeps dispatching until there are no
+// queued requests left, or the oldest request with the earliest finish
+// time does not fit in the seats that are free.
+func (qs *queueset) dispatchAsMuchAsPossibleLocked() {
+	for {
+		dispatched, err := qs.dispatch()
+		switch {
+		case err == decisionErr:
+			// the request had been rejected already, it has been
+			// evicted from its queue, move on to the next one.
+		case err != nil || !dispatched:
+			return
+		}
+	}
+}
+
+// evictor removes a request that is waiting in queue once it has been
+// rejected, stopCh is closed once the request is no longer waiting.
+type evictor struct {
+	removeLocked func()
+	stopCh       chan struct{}
+}
+
+// stopWaitingLocked forgets the given request is waiting in queue, it
+// returns false if the request was not waiting.
+func (qs *queueset) stopWaitingLocked(r fairqueuing.Request) bool {
+	e, waiting := qs.evictors[r]
+	if !waiting {
+		return false
+	}
+	delete(qs.evictors, r)
+	close(e.stopCh)
+	return true
+}
+
 func (qs *queueset) finishLocked(r fairqueuing.Request) {
+	qs.observeLocked(r)
 	seats, _ := r.EstimateCost()
 	qs.seats.InUse -= seats
 	qs.requests.Executing -= 1
-	qs.vclock.Tick()
 	r.OnDone(qs.vclock.RT())
+	qs.removeDrainedQueuesLocked()
+
+	// the seats released by this request may be used by the
+	// requests that are waiting in queue.
+	qs.dispatchAsMuchAsPossibleLocked()
 }
 
 func (qs *queueset) timeoutLocked(r fairqueuing.Request) {
 	seats, _ := r.EstimateCost()
 	qs.seats.Waiting -= seats
 	qs.requests.Waiting -= 1
-	qs.vclock.Tick()
 	r.OnDone(qs.vclock.RT())
 
 	// There are two ways a request is dequeued:
@@ -269,18 +433,18 @@ func (qs *queueset) timeoutLocked(r fairqueuing.Request) {
 	// we are here for b, and we want to track how much the request
 	// spent inside of the queue waiting
 	r.LatencyTrackers().QueueWait.Finish()
+	qs.removeDrainedQueuesLocked()
+
+	// the request may have been at the head of its queue, in which case
+	// the request behind it may fit in the seats that are free.
+	qs.dispatchAsMuchAsPossibleLocked()
 }
 
+// getWorkLocked returns the number of seats requested by all queues,
+// capped at the total number of seats, and the number of active
+// queues; a queue is active if it has a request waiting or executing.
+// Both are kept up to date as the queues change, so the virtual clock
+// can tick in constant time.
 func (qs *queueset) getWorkLocked() (int, int) {
-	naQueues := 0
-	seatsRequested := 0
-	for _, queue := range qs.queues {
-		sc := queue.GetWork()
-		if queue.Length() > 0 || sc.InUse > 0 {
-			naQueues++
-		}
-		seatsRequested += int(sc.Total())
-	}
-
-	return int(math.Min(float64(seatsRequested), float64(qs.totalSeats))), naQueues
+	return int(math.Min(float64(qs.seats.Total()), float64(qs.seatLimitLocked()))), qs.activeQueues
 }
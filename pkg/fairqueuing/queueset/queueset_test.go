@@ -2,7 +2,10 @@ package queueset
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
 
 	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
 )
 
 func Test(t *testing.T) {
@@ -50,25 +54,581 @@ func Test(t *testing.T) {
 	}
 }
 
+func TestVirtualTimeAdvance(t *testing.T) {
+	tests := []struct {
+		name       string
+		totalSeats uint32
+		nQueues    int
+		seats      []uint32
+		wantRate   float64
+	}{
+		{
+			name:       "seats requested less than total seats",
+			totalSeats: 10,
+			nQueues:    4,
+			seats:      []uint32{1, 2, 3},
+			wantRate:   6.0 / 3.0,
+		},
+		{
+			name:       "seats requested exceed total seats",
+			totalSeats: 4,
+			nQueues:    8,
+			seats:      []uint32{3, 3, 3, 3},
+			wantRate:   4.0 / 4.0,
+		},
+		{
+			name:       "one active queue",
+			totalSeats: 5,
+			nQueues:    2,
+			seats:      []uint32{2},
+			wantRate:   2.0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeClock := clocktesting.NewFakeClock(time.Now())
+			qs, err := NewQueueSet(&Config{
+				Clock: fakeClock,
+				QueuingConfig: &QueuingConfig{
+					NQueues:        test.nQueues,
+					QueueMaxLength: 128,
+				},
+				TotalSeats:    test.totalSeats,
+				Events:        events{t: t},
+				QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+			})
+			if err != nil {
+				t.Fatalf("failed to create queueset: %v", err)
+			}
+
+			// enqueue without dispatching, each request lands
+			// in its own queue
+			for i, seats := range test.seats {
+				if _, err := qs.Enqueue(newRequest(uint32(i), seats, time.Second)); err != nil {
+					t.Fatalf("failed to enqueue request: %v", err)
+				}
+			}
+
+			before := qs.vclock.RT()
+			fakeClock.Step(10 * time.Second)
+			qs.vclock.Tick()
+
+			want := virtual.SeatsTimesDuration(test.wantRate, 10*time.Second)
+			if got := qs.vclock.RT() - before; want != got {
+				t.Errorf("expected virtual time to advance by: %s, but got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestDispatchOrderFollowsFinishR(t *testing.T) {
+	recorder := &dispatchRecorder{events: events{t: t}}
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        2,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    6,
+		Events:        recorder,
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	// the round robin selector alternates between the two queues, so
+	// the wide requests land in one queue and the narrow in the other.
+	requests := []*request{
+		newRequest(1, 1, 5*time.Second),
+		newRequest(2, 1, time.Second),
+		newRequest(3, 1, 5*time.Second),
+		newRequest(4, 1, time.Second),
+		newRequest(5, 1, 5*time.Second),
+		newRequest(6, 1, time.Second),
+	}
+	for _, r := range requests {
+		if _, err := qs.Enqueue(r); err != nil {
+			t.Fatalf("failed to enqueue request %s: %v", r, err)
+		}
+	}
+
+	// the fake clock does not move, so R stays at zero and the requests
+	// in each queue are laid out back to back.
+	for i, r := range requests {
+		_, width := r.EstimateCost()
+		wantStartR := virtual.SeatSeconds(i/2) * width
+		if r.StartR() != wantStartR || r.FinishR() != wantStartR+width {
+			t.Errorf("request %s: expected R: [%s, %s), but got: [%s, %s)",
+				r, wantStartR, wantStartR+width, r.StartR(), r.FinishR())
+		}
+	}
+
+	for range requests {
+		if _, err := qs.Dispatch(); err != nil {
+			t.Fatalf("unexpected error from dispatch: %v", err)
+		}
+	}
+
+	want := []string{"2", "4", "6", "1", "3", "5"}
+	if fmt.Sprint(want) != fmt.Sprint(recorder.dequeued) {
+		t.Errorf("expected dispatch order: %v, but got: %v", want, recorder.dequeued)
+	}
+}
+
+func TestWorkAdjustment(t *testing.T) {
+	tests := []struct {
+		name      string
+		execution time.Duration
+		// additionalWork is charged to the request that finishes
+		// on top of its execution.
+		additionalWork time.Duration
+		// wantStartR is the start R of the request waiting behind the
+		// one that finished, once its work is adjusted.
+		wantStartR virtual.SeatSeconds
+		wantOrder  []string
+	}{
+		{
+			name:       "under estimated",
+			execution:  3 * time.Second,
+			wantStartR: virtual.SeatsTimesDuration(1, 3*time.Second),
+			wantOrder:  []string{"1", "2", "4", "3"},
+		},
+		{
+			name:       "over estimated",
+			execution:  500 * time.Millisecond,
+			wantStartR: virtual.SeatsTimesDuration(1, 500*time.Millisecond),
+			wantOrder:  []string{"1", "2", "3", "4"},
+		},
+		{
+			name:           "additional work",
+			execution:      500 * time.Millisecond,
+			additionalWork: time.Second,
+			wantStartR:     virtual.SeatsTimesDuration(1, 1500*time.Millisecond),
+			wantOrder:      []string{"1", "2", "4", "3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &dispatchRecorder{events: events{t: t}}
+			qs, err := NewQueueSet(&Config{
+				Clock: clocktesting.NewFakeClock(time.Now()),
+				QueuingConfig: &QueuingConfig{
+					NQueues:        2,
+					QueueMaxLength: 128,
+				},
+				TotalSeats:    1,
+				Events:        recorder,
+				QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+			})
+			if err != nil {
+				t.Fatalf("failed to create queueset: %v", err)
+			}
+
+			// the requests alternate between the two queues, 1 and 3
+			// share a queue, and so do 2 and 4; 1 executes right away.
+			var requests []*request
+			var finishers []fairqueuing.Finisher
+			for i := 1; i <= 4; i++ {
+				r := newRequest(uint32(i), 1, time.Second)
+				if i == 1 {
+					r.additionalWork = virtual.SeatsTimesDuration(1, test.additionalWork)
+				}
+				finisher, err := qs.EnqueueAndDispatch(r)
+				if err != nil {
+					t.Fatalf("failed to enqueue request %s: %v", r, err)
+				}
+				requests = append(requests, r)
+				finishers = append(finishers, finisher)
+			}
+
+			requests[0].trackers.ExecutionDuration = fakeLatencyTracker{duration: test.execution}
+			finishers[0].Finish(func() {})
+
+			_, width := requests[2].EstimateCost()
+			if r := requests[2]; r.StartR() != test.wantStartR || r.FinishR() != test.wantStartR+width {
+				t.Errorf("request %s: expected R: [%s, %s), but got: [%s, %s)",
+					r, test.wantStartR, test.wantStartR+width, r.StartR(), r.FinishR())
+			}
+			if r := requests[3]; r.StartR() != width || r.FinishR() != 2*width {
+				t.Errorf("expected request %s in the other queue not to be adjusted, but got: [%s, %s)", r, r.StartR(), r.FinishR())
+			}
+
+			// finish the requests in the order they are dispatched, one
+			// at a time.
+			for i := 1; i < len(recorder.dequeued); i++ {
+				var id int
+				fmt.Sscan(recorder.dequeued[i], &id)
+				finishers[id-1].Finish(func() {})
+			}
+			if fmt.Sprint(test.wantOrder) != fmt.Sprint(recorder.dequeued) {
+				t.Errorf("expected dispatch order: %v, but got: %v", test.wantOrder, recorder.dequeued)
+			}
+		})
+	}
+}
+
+func TestBacklogDrainsAsRequestsFinish(t *testing.T) {
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        4,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    2,
+		Events:        events{t: t},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	const total = 8
+	finishers := make([]fairqueuing.Finisher, 0, total)
+	for i := 0; i < total; i++ {
+		finisher, err := qs.EnqueueAndDispatch(newRequest(uint32(i), 1, time.Second))
+		if err != nil {
+			t.Fatalf("failed to enqueue request: %v", err)
+		}
+		finishers = append(finishers, finisher)
+	}
+	if want := (fairqueuing.RequestCount{Executing: 2, Waiting: total - 2}); want != qs.requests {
+		t.Fatalf("expected request count: %+v, but got: %+v", want, qs.requests)
+	}
+
+	// nothing is dispatched explicitly from here on, each request that
+	// finishes should make room for the next one in the backlog.
+	started, release, finished := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	for i := range finishers {
+		finisher := finishers[i]
+		go func() {
+			defer func() { finished <- struct{}{} }()
+			finisher.Finish(func() {
+				started <- struct{}{}
+				<-release
+			})
+		}()
+	}
+
+	receive := func(ch <-chan struct{}, what string) {
+		select {
+		case <-ch:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("timed out waiting for a request to be %s", what)
+		}
+	}
+
+	running := 0
+	for done := 0; done < total; done++ {
+		want := total - done
+		if want > 2 {
+			want = 2
+		}
+		for ; running < want; running++ {
+			receive(started, "dispatched")
+		}
+
+		qs.lock.Lock()
+		count := qs.requests
+		qs.lock.Unlock()
+		if want := (fairqueuing.RequestCount{Executing: uint32(running), Waiting: uint32(total - done - running)}); want != count {
+			t.Errorf("after %d finished, expected request count: %+v, but got: %+v", done, want, count)
+		}
+
+		release <- struct{}{}
+		receive(finished, "finished")
+		running--
+	}
+}
+
+func TestRejectReasons(t *testing.T) {
+	newQueueSet := func(queueMaxLength int) *queueset {
+		qs, err := NewQueueSet(&Config{
+			Clock: clocktesting.NewFakeClock(time.Now()),
+			QueuingConfig: &QueuingConfig{
+				NQueues:        1,
+				QueueMaxLength: queueMaxLength,
+			},
+			TotalSeats:    1,
+			Events:        events{t: t},
+			QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+		})
+		if err != nil {
+			t.Fatalf("failed to create queueset: %v", err)
+		}
+		// occupy the only seat
+		if _, err := qs.EnqueueAndDispatch(newRequest(0, 1, time.Second)); err != nil {
+			t.Fatalf("failed to enqueue request: %v", err)
+		}
+		return qs
+	}
+
+	t.Run("on arrival", func(t *testing.T) {
+		for _, test := range []struct {
+			queueMaxLength int
+			want           fairqueuing.RejectReason
+		}{
+			{queueMaxLength: 0, want: fairqueuing.RejectConcurrencyLimit},
+			{queueMaxLength: 1, want: fairqueuing.RejectQueueFull},
+		} {
+			qs := newQueueSet(test.queueMaxLength)
+			for i := 0; i < test.queueMaxLength; i++ {
+				if _, err := qs.EnqueueAndDispatch(newRequest(uint32(i+1), 1, time.Second)); err != nil {
+					t.Fatalf("failed to enqueue request: %v", err)
+				}
+			}
+
+			_, err := qs.EnqueueAndDispatch(newRequest(100, 1, time.Second))
+			var rejected *fairqueuing.RejectedError
+			if !errors.As(err, &rejected) || rejected.Reason != test.want {
+				t.Errorf("expected the request to be rejected with reason %q, but got: %v", test.want, err)
+			}
+		}
+	})
+
+	t.Run("while waiting", func(t *testing.T) {
+		for _, test := range []struct {
+			name string
+			ctx  func() (context.Context, context.CancelFunc)
+			want fairqueuing.RejectReason
+		}{
+			{
+				name: "timed out",
+				ctx: func() (context.Context, context.CancelFunc) {
+					return context.WithTimeout(context.Background(), time.Millisecond)
+				},
+				want: fairqueuing.RejectTimedOutInQueue,
+			},
+			{
+				name: "canceled",
+				ctx: func() (context.Context, context.CancelFunc) {
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					return ctx, cancel
+				},
+				want: fairqueuing.RejectCancelledByClient,
+			},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				qs := newQueueSet(1)
+				ctx, cancel := test.ctx()
+				defer cancel()
+				r := newRequest(1, 1, time.Second)
+				r.DecisionWaiterSetter = promise.New(ctx)
+				finisher, err := qs.EnqueueAndDispatch(r)
+				if err != nil {
+					t.Fatalf("failed to enqueue request: %v", err)
+				}
+				if got := r.RejectReason(); got != fairqueuing.RejectReasonNone {
+					t.Errorf("expected no reject reason before a decision, but got: %q", got)
+				}
+
+				var executed bool
+				finisher.Finish(func() { executed = true })
+				if executed {
+					t.Errorf("expected the request to be rejected")
+				}
+				if got := r.RejectReason(); got != test.want {
+					t.Errorf("expected reject reason: %q, but got: %q", test.want, got)
+				}
+				if want := (fairqueuing.RequestCount{Executing: 1}); want != qs.requests {
+					t.Errorf("expected request count: %+v, but got: %+v", want, qs.requests)
+				}
+			})
+		}
+	})
+}
+
+func TestEvictionWhileWaiting(t *testing.T) {
+	recorder := &rejectRecorder{events: events{t: t}}
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    1,
+		Events:        recorder,
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	// 0 occupies the only seat, 1 and 2 wait behind it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := []*request{newRequest(0, 1, time.Second), newRequest(1, 1, time.Second), newRequest(2, 1, time.Second)}
+	requests[1].ctx = ctx
+	requests[1].DecisionWaiterSetter = promise.New(ctx)
+	var finishers []fairqueuing.Finisher
+	for _, r := range requests {
+		finisher, err := qs.EnqueueAndDispatch(r)
+		if err != nil {
+			t.Fatalf("failed to enqueue request %s: %v", r, err)
+		}
+		finishers = append(finishers, finisher)
+	}
+
+	// the request is evicted as soon as its context is canceled, its
+	// Finish has not been called yet.
+	cancel()
+	for deadline := time.Now().Add(30 * time.Second); !func() bool {
+		qs.lock.Lock()
+		defer qs.lock.Unlock()
+		return qs.requests.Waiting == 1
+	}(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the canceled request to be evicted")
+		}
+	}
+	if got := qs.queues[0].Length(); got != 1 {
+		t.Errorf("expected one request left in the queue, but got: %d", got)
+	}
+	if want := (fairqueuing.SeatCount{InUse: 1, Waiting: 1}); want != qs.seats {
+		t.Errorf("expected seat count: %+v, but got: %+v", want, qs.seats)
+	}
+	if got := requests[1].RejectReason(); got != fairqueuing.RejectCancelledByClient {
+		t.Errorf("expected reject reason: %q, but got: %q", fairqueuing.RejectCancelledByClient, got)
+	}
+
+	// the seat that frees up goes to the request that is still waiting
+	finishers[0].Finish(func() {})
+	var executed []uint32
+	for _, i := range []int{2, 1} {
+		finishers[i].Finish(func() { executed = append(executed, requests[i].id) })
+	}
+	if fmt.Sprint(executed) != "[2]" {
+		t.Errorf("expected only request 2 to be executed, but got: %v", executed)
+	}
+	if qs.requests != (fairqueuing.RequestCount{}) || qs.seats != (fairqueuing.SeatCount{}) {
+		t.Errorf("expected no request to be accounted for, but got: %+v, %+v", qs.requests, qs.seats)
+	}
+	if got := recorder.get(); fmt.Sprint(got) != "[1]" {
+		t.Errorf("expected request 1 to be rejected once, but got: %v", got)
+	}
+}
+
+func TestEvictionWatchEndsOnceNotWaiting(t *testing.T) {
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    2,
+		Events:        noopEvents{},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	// waitForGoroutines waits until at most want goroutines are alive
+	waitForGoroutines := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(30 * time.Second); runtime.NumGoroutine() > want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected at most %d goroutines, but got: %d", want, runtime.NumGoroutine())
+			}
+		}
+	}
+
+	// the contexts of the requests are never canceled, like those of
+	// the watches that are served for as long as the client wants.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	before := runtime.NumGoroutine()
+	var finishers []fairqueuing.Finisher
+	for i := 0; i < 10; i++ {
+		r := newRequest(uint32(i), 1, time.Second)
+		r.ctx = ctx
+		r.DecisionWaiterSetter = promise.New(ctx)
+		finisher, err := qs.EnqueueAndDispatch(r)
+		if err != nil {
+			t.Fatalf("failed to enqueue request %s: %v", r, err)
+		}
+		finishers = append(finishers, finisher)
+	}
+
+	// only the requests that are waiting are watched, the 2 that have
+	// been dispatched are not.
+	waitForGoroutines(before + 8)
+
+	// the requests that are rejected while waiting are not watched
+	// either.
+	func() {
+		qs.lock.Lock()
+		defer qs.lock.Unlock()
+		qs.rejectWaitingLocked(fairqueuing.RejectShuttingDown)
+	}()
+	waitForGoroutines(before)
+
+	for _, finisher := range finishers {
+		finisher.Finish(func() {})
+	}
+	if qs.requests != (fairqueuing.RequestCount{}) || qs.seats != (fairqueuing.SeatCount{}) {
+		t.Errorf("expected no request to be accounted for, but got: %+v, %+v", qs.requests, qs.seats)
+	}
+}
+
+type rejectRecorder struct {
+	events
+	lock     sync.Mutex
+	rejected []string
+}
+
+func (e *rejectRecorder) Rejected(r fairqueuing.Request, reason fairqueuing.RejectReason) {
+	e.events.Rejected(r, reason)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.rejected = append(e.rejected, r.String())
+}
+
+func (e *rejectRecorder) get() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string(nil), e.rejected...)
+}
+
+type dispatchRecorder struct {
+	events
+	dequeued []string
+}
+
+func (e *dispatchRecorder) Dequeued(q fairqueuing.FairQueue, r fairqueuing.Request) {
+	e.events.Dequeued(q, r)
+	e.dequeued = append(e.dequeued, r.String())
+}
+
 type request struct {
-	id uint32
+	id     uint32
+	flowID fairqueuing.FlowIDType
+	// ctx is the queue wait context, if nil the request waits forever
+	ctx context.Context
 	virtual.RTracker
-	seats    uint32
-	duration time.Duration
-	trackers fairqueuing.LatencyTrackers
+	seats          uint32
+	duration       time.Duration
+	additionalWork virtual.SeatSeconds
+	trackers       fairqueuing.LatencyTrackers
 	fairqueuing.DecisionWaiterSetter
 }
 
 func (r *request) GetFlowID() fairqueuing.FlowIDType {
-	return fairqueuing.FlowIDType(0)
+	return r.flowID
 }
 func (r *request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
 	return context.Background()
 }
 func (r *request) CancelFunc() context.CancelFunc { return nil }
 func (r *request) EstimateCost() (seats uint32, width virtual.SeatSeconds) {
-	return r.seats, virtual.SeatsTimesDuration(float64(r.seats), r.duration)
+	return r.seats, virtual.SeatsTimesDuration(float64(r.seats), r.duration) + r.additionalWork
 }
+func (r *request) AdditionalWork() virtual.SeatSeconds          { return r.additionalWork }
 func (r *request) LatencyTrackers() fairqueuing.LatencyTrackers { return r.trackers }
 func (r *request) String() string                               { return fmt.Sprintf("%d", r.id) }
 
@@ -82,7 +642,7 @@ func newRequest(id uint32, seats uint32, duration time.Duration) *request {
 		trackers: fairqueuing.LatencyTrackers{
 			QueueWait:                 fakeLatencyTracker{},
 			PostDecisionExecutionWait: fakeLatencyTracker{},
-			ExecutionDuration:         fakeLatencyTracker{},
+			ExecutionDuration:         fakeLatencyTracker{duration: duration},
 			TotalDuration:             fakeLatencyTracker{},
 		},
 	}
@@ -107,14 +667,18 @@ func (e events) DecisionChanged(r fairqueuing.Request, d fairqueuing.DecisionTyp
 func (e events) Disposed(r fairqueuing.Request) {
 	e.t.Logf("disposed: %q", r)
 }
-func (e events) Timeout(r fairqueuing.Request) {
-	e.t.Logf("timeout: %q", r)
+func (e events) Rejected(r fairqueuing.Request, reason fairqueuing.RejectReason) {
+	e.t.Logf("rejected: %q, reason: %s", r, reason)
 }
 
-type fakeLatencyTracker struct{}
+// fakeLatencyTracker reports the given duration, the execution of a
+// request takes as long as it was estimated to.
+type fakeLatencyTracker struct {
+	duration time.Duration
+}
 
 func (f fakeLatencyTracker) Start()  {}
 func (f fakeLatencyTracker) Finish() {}
-func (f fakeLatencyTracker) GetDuration() (startedAt time.Time, duration time.Duration) {
-	return time.Time{}, 0
+func (f fakeLatencyTracker) Get() (startedAt time.Time, duration time.Duration) {
+	return time.Time{}, f.duration
 }
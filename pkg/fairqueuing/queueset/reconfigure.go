@@ -0,0 +1,109 @@
+package queueset
+
+import (
+	"fmt"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+// Validate returns an error if the given configuration can not be used
+// to create, or to reconfigure a queueset.
+func Validate(config *Config) error {
+	if config.TotalSeats < 1 {
+		return fmt.Errorf("seats must be positive")
+	}
+	if config.QueuingConfig == nil {
+		return fmt.Errorf("queuing configuration must be specified")
+	}
+	if config.QueuingConfig.NQueues < 1 {
+		return fmt.Errorf("number of queues must be positive")
+	}
+	return nil
+}
+
+func (qs *queueset) newQueue(index int) *fairQueue {
+	return &fairQueue{
+		id:     uint32(index + 1),
+		index:  index,
+		fifo:   NewFIFO(),
+		vclock: qs.vclock,
+		activeChanged: func(active bool) {
+			if active {
+				qs.activeQueues++
+				return
+			}
+			qs.activeQueues--
+		},
+	}
+}
+
+// Reconfigure applies the given configuration to the queueset without
+// dropping the requests that are waiting or executing.
+//
+// If the number of queues grows, new queues are added. If it shrinks,
+// the queues beyond the new number are retired, no new request is
+// assigned to them, the requests waiting in them are dispatched as
+// usual, and they are removed once they drain.
+//
+// The queue selector is replaced if the configuration specifies a
+// different one, otherwise it is reconfigured with the new number of
+// queues and hand size, if it supports it. The new seat limits are
+// applied right away, requests that fit are dispatched immediately.
+// The limiter is replaced with the one the configuration specifies, if
+// any. The name, clock, and events of the queueset are not changed.
+func (qs *queueset) Reconfigure(config *Config) error {
+	if err := Validate(config); err != nil {
+		return err
+	}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	nQueues := config.QueuingConfig.NQueues
+	assigner := qs.assigner
+	if config.QueueSelector != nil {
+		assigner = config.QueueSelector
+	}
+	if reconfigurable, ok := assigner.(fairqueuing.ReconfigurableQueueSelector); ok {
+		if err := reconfigurable.Reconfigure(nQueues, config.QueuingConfig.HandSize); err != nil {
+			return err
+		}
+	}
+	qs.assigner = assigner
+
+	qs.vclock.Tick()
+	for i := len(qs.queues); i < nQueues; i++ {
+		qs.queues = append(qs.queues, qs.newQueue(i))
+	}
+	qs.nQueues = nQueues
+	qs.selector.SetQueues(qs.queues)
+	qs.removeDrainedQueuesLocked()
+
+	qs.totalSeats = config.TotalSeats
+	qs.queueMaxLength = config.QueuingConfig.QueueMaxLength
+	qs.setLimiterLocked(config.Limiter)
+	qs.dispatchAsMuchAsPossibleLocked()
+	return nil
+}
+
+// removeDrainedQueuesLocked removes the retired queues that no longer
+// have any request waiting or executing, the queues are removed from
+// the end so that the index of the remaining queues does not change.
+func (qs *queueset) removeDrainedQueuesLocked() {
+	n := len(qs.queues)
+	for ; n > qs.nQueues; n-- {
+		queue := qs.queues[n-1]
+		if queue.Length() > 0 || queue.GetWork().Total() > 0 {
+			break
+		}
+	}
+	if n == len(qs.queues) {
+		return
+	}
+
+	for i := n; i < len(qs.queues); i++ {
+		qs.queues[i] = nil
+	}
+	qs.queues = qs.queues[:n]
+	qs.selector.SetQueues(qs.queues)
+}
@@ -0,0 +1,146 @@
+package queueset
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestReconfigureUnderLoad(t *testing.T) {
+	tests := []struct {
+		name        string
+		nQueues     int
+		newNQueues  int
+		newHandSize int
+	}{
+		{name: "shrink", nQueues: 8, newNQueues: 2, newHandSize: 1},
+		{name: "grow", nQueues: 2, newNQueues: 16, newHandSize: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector, err := queueselector.NewShuffleShardingQueueSelector(test.nQueues, 2)
+			if err != nil {
+				t.Fatalf("failed to create queue selector: %v", err)
+			}
+			qs, err := NewQueueSet(&Config{
+				Clock: clocktesting.NewFakeClock(time.Now()),
+				QueuingConfig: &QueuingConfig{
+					NQueues:        test.nQueues,
+					HandSize:       2,
+					QueueMaxLength: 128,
+				},
+				TotalSeats:    1,
+				Events:        noopEvents{},
+				QueueSelector: selector,
+			})
+			if err != nil {
+				t.Fatalf("failed to create queueset: %v", err)
+			}
+
+			var executed int32
+			var wg sync.WaitGroup
+			enqueue := func(from, to int) {
+				for i := from; i < to; i++ {
+					r := newRequest(uint32(i), 1, time.Second)
+					r.flowID = fairqueuing.FlowIDType(i * 7919)
+					finisher, err := qs.EnqueueAndDispatch(r)
+					if err != nil {
+						t.Fatalf("failed to enqueue request: %v", err)
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						finisher.Finish(func() { atomic.AddInt32(&executed, 1) })
+					}()
+				}
+			}
+
+			// with one seat, and the executing requests finishing
+			// concurrently, some of the requests are still waiting
+			// in queue when the queueset is reconfigured.
+			enqueue(0, 100)
+			if err := qs.Reconfigure(&Config{
+				QueuingConfig: &QueuingConfig{
+					NQueues:        test.newNQueues,
+					HandSize:       test.newHandSize,
+					QueueMaxLength: 128,
+				},
+				TotalSeats: 3,
+			}); err != nil {
+				t.Fatalf("failed to reconfigure: %v", err)
+			}
+			if got := qs.TotalQueues(); got != test.newNQueues {
+				t.Errorf("expected %d queues to accept new requests, but got: %d", test.newNQueues, got)
+			}
+			enqueue(100, 200)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				wg.Wait()
+			}()
+			select {
+			case <-done:
+			case <-time.After(30 * time.Second):
+				t.Fatalf("timed out waiting for the requests to finish")
+			}
+
+			if got := atomic.LoadInt32(&executed); got != 200 {
+				t.Errorf("expected %d requests to be executed, but got: %d", 200, got)
+			}
+
+			qs.lock.Lock()
+			defer qs.lock.Unlock()
+			if qs.requests != (fairqueuing.RequestCount{}) || qs.seats != (fairqueuing.SeatCount{}) {
+				t.Errorf("expected no request to be accounted for, but got: %+v, %+v", qs.requests, qs.seats)
+			}
+			if len(qs.queues) != test.newNQueues {
+				t.Errorf("expected the retired queues to be removed, but got %d queues", len(qs.queues))
+			}
+			for _, queue := range qs.queues {
+				if queue.Length() != 0 || queue.GetWork() != (fairqueuing.SeatCount{}) {
+					t.Errorf("expected queue %s to be empty, but got length: %d, work: %+v", queue, queue.Length(), queue.GetWork())
+				}
+			}
+		})
+	}
+}
+
+func TestReconfigureInvalid(t *testing.T) {
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        4,
+			HandSize:       2,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    1,
+		Events:        noopEvents{},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	selector, _ := queueselector.NewShuffleShardingQueueSelector(4, 2)
+	for _, config := range []*Config{
+		{TotalSeats: 0, QueuingConfig: &QueuingConfig{NQueues: 4}},
+		{TotalSeats: 1},
+		{TotalSeats: 1, QueuingConfig: &QueuingConfig{NQueues: 0}},
+		{TotalSeats: 1, QueuingConfig: &QueuingConfig{NQueues: 2, HandSize: 4}, QueueSelector: selector},
+	} {
+		if err := qs.Reconfigure(config); err == nil {
+			t.Errorf("expected an error for configuration: %+v", config)
+		}
+	}
+	if qs.TotalQueues() != 4 || qs.TotalSeats() != 1 {
+		t.Errorf("expected the queueset to be unchanged, but got queues: %d, seats: %d", qs.TotalQueues(), qs.TotalSeats())
+	}
+}
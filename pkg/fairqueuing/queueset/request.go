@@ -11,7 +11,9 @@ type Events interface {
 	DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType)
 
 	Disposed(fairqueuing.Request)
-	Timeout(fairqueuing.Request)
+	// Rejected is invoked when a request is rejected, either on
+	// arrival, or while it is waiting in its queue.
+	Rejected(fairqueuing.Request, fairqueuing.RejectReason)
 }
 
 // walkFunc is called for each request in the list in the
@@ -51,6 +53,8 @@ type fifo interface {
 
 type fairqueue interface {
 	fairqueuing.FairQueue
+	Index() int
+	Walk(walkFunc)
 	Dequeue() (request fairqueuing.Request, preExecution disposer, ok bool)
 	Enqueue(r fairqueuing.Request) (postExecution disposer, postTimeout disposer, err error)
 }
@@ -0,0 +1,36 @@
+package queueset
+
+import (
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+)
+
+// MinRetryAfter is the shortest retry hint given to a rejected request
+const MinRetryAfter = time.Second
+
+// retryAfterLocked returns how long a request rejected from the given
+// queue should wait before it is retried. It is the time the seats of
+// the queueset take to serve the work that is waiting in the queue,
+// and it is at least MinRetryAfter.
+//
+// The hint is computed from the queue the request was assigned to, at
+// the time it is rejected, the queue selection is not run again.
+func (qs *queueset) retryAfterLocked(queue fairqueue) time.Duration {
+	limit := qs.seatLimitLocked()
+	if limit == 0 {
+		return MinRetryAfter
+	}
+
+	var workAhead virtual.SeatSeconds
+	queue.Walk(func(r fairqueuing.Request) bool {
+		_, width := r.EstimateCost()
+		workAhead += width
+		return true
+	})
+	if retryAfter := workAhead.DurationPerSeat(float64(limit)); retryAfter > MinRetryAfter {
+		return retryAfter
+	}
+	return MinRetryAfter
+}
@@ -0,0 +1,91 @@
+package queueset
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/promise"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestRetryAfter(t *testing.T) {
+	recorder := &dispatchRecorder{events: events{t: t}}
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        2,
+			QueueMaxLength: 3,
+		},
+		TotalSeats:    2,
+		Events:        recorder,
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+	rejectedHint := func(r *request) time.Duration {
+		_, err := qs.EnqueueAndDispatch(r)
+		var rejected *fairqueuing.RejectedError
+		if !errors.As(err, &rejected) {
+			t.Fatalf("expected request %s to be rejected, but got: %v", r, err)
+		}
+		return rejected.RetryAfter
+	}
+
+	// the requests alternate between the two queues: the first two
+	// occupy the seats, the odd ones wait for 1*10s + 2*5s + 1*4s
+	// seat-seconds to be served by two seats, the even ones for 3
+	// seat-seconds.
+	for i, r := range []*request{
+		newRequest(0, 1, time.Minute),
+		newRequest(1, 1, time.Minute),
+		newRequest(2, 1, time.Second),
+		newRequest(3, 1, 10*time.Second),
+		newRequest(4, 1, time.Second),
+		newRequest(5, 2, 5*time.Second),
+		newRequest(6, 1, time.Second),
+		newRequest(7, 1, 4*time.Second),
+	} {
+		if _, err := qs.EnqueueAndDispatch(r); err != nil {
+			t.Fatalf("failed to enqueue request %d: %v", i, err)
+		}
+	}
+
+	// the hint is given for the queue each request is rejected from,
+	// and giving it does not move the round robin on.
+	if want, got := 1500*time.Millisecond, rejectedHint(newRequest(8, 1, time.Second)); want != got {
+		t.Errorf("expected retry hint: %s, but got: %s", want, got)
+	}
+	if want, got := 12*time.Second, rejectedHint(newRequest(9, 1, time.Second)); want != got {
+		t.Errorf("expected retry hint: %s, but got: %s", want, got)
+	}
+	if want, got := 1500*time.Millisecond, rejectedHint(newRequest(10, 1, time.Second)); want != got {
+		t.Errorf("expected retry hint: %s, but got: %s", want, got)
+	}
+
+	// a request rejected while waiting is given the hint of its queue
+	// once it is removed from it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qs.lock.Lock()
+	qs.queueMaxLength = 4
+	qs.lock.Unlock()
+	waiting := newRequest(11, 1, time.Second)
+	waiting.ctx, waiting.DecisionWaiterSetter = ctx, promise.New(ctx)
+	finisher, err := qs.EnqueueAndDispatch(waiting)
+	if err != nil {
+		t.Fatalf("failed to enqueue request %s: %v", waiting, err)
+	}
+	cancel()
+	finisher.Finish(func() {
+		t.Errorf("expected request %s not to be served", waiting)
+	})
+	if want, got := 12*time.Second, finisher.(*queuedFinisher).RetryAfter(); want != got {
+		t.Errorf("expected retry hint: %s, but got: %s", want, got)
+	}
+}
@@ -0,0 +1,69 @@
+package queueset
+
+import (
+	"context"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+// Shutdown stops the queueset from accepting new requests, they are
+// rejected with RejectShuttingDown. The requests that are waiting in
+// queue keep being dispatched as the seats free up, and Shutdown
+// returns once the Finish of every request accepted so far has
+// completed.
+//
+// If the context is done first, the requests that are still waiting
+// are rejected with RejectShuttingDown; the requests that are executing
+// are not interrupted, and Shutdown still waits for every Finish to
+// complete before it returns the error of the context.
+func (qs *queueset) Shutdown(ctx context.Context) error {
+	func() {
+		qs.lock.Lock()
+		defer qs.lock.Unlock()
+		qs.shuttingDown = true
+	}()
+
+	// no request is accepted from here on, so the wait group does
+	// not grow while we wait on it.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		qs.inflight.Wait()
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	func() {
+		qs.lock.Lock()
+		defer qs.lock.Unlock()
+		qs.rejectWaitingLocked(fairqueuing.RejectShuttingDown)
+	}()
+
+	// the rejected requests are done as soon as their Finish is called,
+	// but the executing ones are not, the caller must not tear down what
+	// they use until they are.
+	<-drained
+	return ctx.Err()
+}
+
+// rejectWaitingLocked rejects all the requests waiting in queue, and
+// evicts them, the dispatching stops for good.
+func (qs *queueset) rejectWaitingLocked(reason fairqueuing.RejectReason) {
+	qs.dispatchStopped = true
+	var waiting []fairqueuing.Request
+	for _, queue := range qs.queues {
+		queue.Walk(func(r fairqueuing.Request) bool {
+			waiting = append(waiting, r)
+			return true
+		})
+	}
+	for _, r := range waiting {
+		// a request that has been rejected already keeps its reason
+		r.Reject(reason)
+		qs.evictors[r].removeLocked()
+	}
+}
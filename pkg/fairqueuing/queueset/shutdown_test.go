@@ -0,0 +1,138 @@
+package queueset
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestShutdown(t *testing.T) {
+	newQueueSet := func(t *testing.T) (*queueset, []fairqueuing.Finisher, []*request) {
+		qs, err := NewQueueSet(&Config{
+			Clock: clocktesting.NewFakeClock(time.Now()),
+			QueuingConfig: &QueuingConfig{
+				NQueues:        2,
+				QueueMaxLength: 128,
+			},
+			TotalSeats:    1,
+			Events:        events{t: t},
+			QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+		})
+		if err != nil {
+			t.Fatalf("failed to create queueset: %v", err)
+		}
+
+		// one request executes, the others wait
+		var finishers []fairqueuing.Finisher
+		var requests []*request
+		for i := 0; i < 3; i++ {
+			r := newRequest(uint32(i), 1, time.Second)
+			finisher, err := qs.EnqueueAndDispatch(r)
+			if err != nil {
+				t.Fatalf("failed to enqueue request: %v", err)
+			}
+			finishers = append(finishers, finisher)
+			requests = append(requests, r)
+		}
+		return qs, finishers, requests
+	}
+
+	expectShuttingDown := func(t *testing.T, qs *queueset) {
+		_, err := qs.EnqueueAndDispatch(newRequest(100, 1, time.Second))
+		var rejected *fairqueuing.RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != fairqueuing.RejectShuttingDown {
+			t.Errorf("expected the request to be rejected while shutting down, but got: %v", err)
+		}
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		qs, finishers, _ := newQueueSet(t)
+
+		shutdownCh := make(chan error, 1)
+		go func() { shutdownCh <- qs.Shutdown(context.Background()) }()
+		for !func() bool {
+			qs.lock.Lock()
+			defer qs.lock.Unlock()
+			return qs.shuttingDown
+		}() {
+			time.Sleep(time.Millisecond)
+		}
+		expectShuttingDown(t, qs)
+
+		executed := 0
+		for _, finisher := range finishers {
+			select {
+			case err := <-shutdownCh:
+				t.Fatalf("expected shutdown to wait for the requests, but it returned: %v", err)
+			default:
+			}
+			finisher.Finish(func() { executed++ })
+		}
+		select {
+		case err := <-shutdownCh:
+			if err != nil {
+				t.Errorf("expected no error, but got: %v", err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("expected shutdown to return once the requests are done")
+		}
+		if executed != len(finishers) {
+			t.Errorf("expected all %d requests to be executed, but got: %d", len(finishers), executed)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		qs, finishers, requests := newQueueSet(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		shutdownCh := make(chan error, 1)
+		go func() { shutdownCh <- qs.Shutdown(ctx) }()
+		for !func() bool {
+			qs.lock.Lock()
+			defer qs.lock.Unlock()
+			return qs.dispatchStopped
+		}() {
+			time.Sleep(time.Millisecond)
+		}
+		expectShuttingDown(t, qs)
+
+		// the waiting requests are rejected, the executing one is not
+		// interrupted, and does not make room for the others; shutdown
+		// waits for all of them to finish.
+		executed := 0
+		for i := len(finishers) - 1; i >= 0; i-- {
+			select {
+			case err := <-shutdownCh:
+				t.Fatalf("expected shutdown to wait for the requests, but it returned: %v", err)
+			default:
+			}
+			finishers[i].Finish(func() { executed++ })
+		}
+		select {
+		case err := <-shutdownCh:
+			if err != context.Canceled {
+				t.Errorf("expected error: %v, but got: %v", context.Canceled, err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("expected shutdown to return once the requests are done")
+		}
+		if executed != 1 {
+			t.Errorf("expected only the executing request to be executed, but got: %d", executed)
+		}
+		for _, r := range requests[1:] {
+			if reason := r.RejectReason(); reason != fairqueuing.RejectShuttingDown {
+				t.Errorf("expected request %s to be rejected with reason %q, but got: %q", r, fairqueuing.RejectShuttingDown, reason)
+			}
+		}
+		if qs.requests != (fairqueuing.RequestCount{}) || qs.seats != (fairqueuing.SeatCount{}) {
+			t.Errorf("expected no request to be accounted for, but got: %+v, %+v", qs.requests, qs.seats)
+		}
+	})
+}
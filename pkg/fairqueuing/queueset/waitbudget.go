@@ -0,0 +1,46 @@
+package queueset
+
+import (
+	"math"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+// exceedsWaitBudgetLocked returns true if the given request has a wait
+// budget, and it is expected to wait in the given queue for longer.
+func (qs *queueset) exceedsWaitBudgetLocked(queue fairqueue, r fairqueuing.Request) bool {
+	budgeter, ok := r.(fairqueuing.WaitBudgeter)
+	if !ok {
+		return false
+	}
+	budget, ok := budgeter.WaitBudget()
+	return ok && qs.expectedWaitLocked(queue, r) > budget
+}
+
+// expectedWaitLocked estimates how long the given request would wait
+// in the given queue: it starts once the virtual time reaches the
+// finish time of the work ahead of it in its queue, and the virtual
+// time advances at the rate of the seats divided among the active
+// queues. A request with nothing ahead of it in its queue is expected
+// to be dispatched as soon as a seat frees up.
+func (qs *queueset) expectedWaitLocked(queue fairqueue, r fairqueuing.Request) time.Duration {
+	seats, _ := r.EstimateCost()
+	limit := qs.seatLimitLocked()
+	if qs.requests.Waiting == 0 && qs.seats.InUse+seats <= limit {
+		return 0
+	}
+	if queue.Length() == 0 && queue.GetWork().InUse == 0 {
+		return 0
+	}
+	if limit == 0 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	rt, ahead := qs.vclock.RT(), queue.GetNextFinishR()
+	if ahead <= rt {
+		return 0
+	}
+	_, naQueues := qs.getWorkLocked()
+	return (ahead - rt).DurationPerSeat(float64(limit) / float64(naQueues))
+}
@@ -0,0 +1,63 @@
+package queueset
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestWaitBudget(t *testing.T) {
+	qs, err := NewQueueSet(&Config{
+		Clock: clocktesting.NewFakeClock(time.Now()),
+		QueuingConfig: &QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		TotalSeats:    1,
+		Events:        events{t: t},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	// each request takes a second of the only seat, so a request is
+	// expected to wait a second for each one accepted before it.
+	tests := []struct {
+		budget       time.Duration
+		wantRejected bool
+	}{
+		{budget: 0},
+		{budget: 500 * time.Millisecond, wantRejected: true},
+		{budget: 2 * time.Second},
+		{budget: 1500 * time.Millisecond, wantRejected: true},
+		{budget: 2 * time.Second},
+	}
+	for i, test := range tests {
+		r := &budgetedRequest{request: newRequest(uint32(i), 1, time.Second), budget: test.budget}
+		_, err := qs.EnqueueAndDispatch(r)
+
+		var rejected *fairqueuing.RejectedError
+		switch {
+		case test.wantRejected && (!errors.As(err, &rejected) || rejected.Reason != fairqueuing.RejectWaitBudgetExceeded):
+			t.Errorf("[%d]: expected the request to be rejected with %q, but got: %v", i, fairqueuing.RejectWaitBudgetExceeded, err)
+		case !test.wantRejected && err != nil:
+			t.Errorf("[%d]: expected the request to be accepted, but got: %v", i, err)
+		}
+	}
+	if want := (fairqueuing.RequestCount{Executing: 1, Waiting: 2}); want != qs.requests {
+		t.Errorf("expected request count: %+v, but got: %+v", want, qs.requests)
+	}
+}
+
+type budgetedRequest struct {
+	*request
+	budget time.Duration
+}
+
+func (r *budgetedRequest) WaitBudget() (time.Duration, bool) { return r.budget, true }
@@ -0,0 +1,59 @@
+package fairqueuing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RejectReason tells why a request was not served
+type RejectReason string
+
+const (
+	RejectReasonNone RejectReason = ""
+
+	// the queue the request was assigned to is full
+	RejectQueueFull RejectReason = "queue-full"
+
+	// the seats are all occupied, and the request can not wait
+	// because queuing is disabled
+	RejectConcurrencyLimit RejectReason = "concurrency-limit"
+
+	// the request timed out while waiting in its queue
+	RejectTimedOutInQueue RejectReason = "timed-out-in-queue"
+
+	// the client went away while the request was waiting in its queue
+	RejectCancelledByClient RejectReason = "cancelled-by-client"
+
+	// the queue set is shutting down
+	RejectShuttingDown RejectReason = "shutting-down"
+
+	// the request is expected to wait in queue for longer than its
+	// budget allows, it is rejected on arrival instead of timing out
+	RejectWaitBudgetExceeded RejectReason = "wait-budget-exceeded"
+)
+
+// QueueWaitRejectReason returns why a request is rejected once its
+// queue wait context is done with the given error: the context is
+// derived from the context of the request, it is canceled if the
+// client goes away, and it exceeds its deadline if the request waits
+// too long.
+func QueueWaitRejectReason(err error) RejectReason {
+	if errors.Is(err, context.Canceled) {
+		return RejectCancelledByClient
+	}
+	return RejectTimedOutInQueue
+}
+
+// RejectedError is returned when a request is rejected on arrival
+type RejectedError struct {
+	Reason RejectReason
+	// RetryAfter is how long the request should wait before it is
+	// retried, it is zero if the dispatcher gives no hint.
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("request rejected: %s", e.Reason)
+}
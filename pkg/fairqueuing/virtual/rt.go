@@ -6,10 +6,11 @@ import (
 	utilsclock "k8s.io/utils/clock"
 )
 
-func NewRTClock(clock utilsclock.Clock, qf QueueSetActiveFunc) RTClock {
+func NewRTClock(clock utilsclock.PassiveClock, qf QueueSetActiveFunc) RTClock {
 	return &vclock{
-		clock: clock,
-		qf:    qf,
+		clock:        clock,
+		qf:           qf,
+		lastTickedAt: clock.Now(),
 	}
 }
 
@@ -17,13 +18,25 @@ func NewRTClock(clock utilsclock.Clock, qf QueueSetActiveFunc) RTClock {
 // the number of active queues in a given queue set
 type QueueSetActiveFunc func() (seats int, naQueues int)
 
+// RTClock tracks the virtual time R of a queue set. R advances at the
+// rate of min(seats requested, total seats) / number of active queues
+// for every second of real time elapsed.
+//
+// An RTClock is not safe for concurrent use by multiple goroutines,
+// the caller is expected to hold the queue set lock.
 type RTClock interface {
+	// Tick advances the virtual time to the present, it must be
+	// invoked before the state of the queue set is changed so that
+	// the time elapsed since the last tick is accounted for using the
+	// rate that was in effect during that interval.
 	Tick()
+
+	// RT returns the virtual time as of the last Tick.
 	RT() SeatSeconds
 }
 
 type vclock struct {
-	clock utilsclock.Clock
+	clock utilsclock.PassiveClock
 	qf    QueueSetActiveFunc
 
 	lastTickedAt time.Time
@@ -31,7 +44,7 @@ type vclock struct {
 }
 
 func (vc *vclock) RT() SeatSeconds {
-	return 0
+	return vc.rt
 }
 
 func (vc *vclock) Tick() {
@@ -40,6 +53,9 @@ func (vc *vclock) Tick() {
 		vc.lastTickedAt = now
 	}()
 	timeSinceLastTick := now.Sub(vc.lastTickedAt)
+	if timeSinceLastTick <= 0 {
+		return
+	}
 
 	seats, naQueues := vc.qf()
 	if naQueues == 0 {
@@ -0,0 +1,90 @@
+package virtual
+
+import (
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestRTClock(t *testing.T) {
+	tests := []struct {
+		name     string
+		seats    int
+		naQueues int
+		elapsed  time.Duration
+		wantRT   SeatSeconds
+	}{
+		{
+			name:     "no active queues, virtual time does not advance",
+			seats:    10,
+			naQueues: 0,
+			elapsed:  time.Second,
+			wantRT:   0,
+		},
+		{
+			name:     "one active queue using one seat",
+			seats:    1,
+			naQueues: 1,
+			elapsed:  time.Second,
+			wantRT:   SeatsTimesDuration(1, time.Second),
+		},
+		{
+			name:     "seats shared among active queues",
+			seats:    10,
+			naQueues: 4,
+			elapsed:  2 * time.Second,
+			wantRT:   SeatsTimesDuration(2.5, 2*time.Second),
+		},
+		{
+			name:     "no time elapsed",
+			seats:    10,
+			naQueues: 4,
+			elapsed:  0,
+			wantRT:   0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeClock := clocktesting.NewFakePassiveClock(time.Now())
+			vclock := NewRTClock(fakeClock, func() (int, int) {
+				return test.seats, test.naQueues
+			})
+
+			fakeClock.SetTime(fakeClock.Now().Add(test.elapsed))
+			vclock.Tick()
+			if got := vclock.RT(); test.wantRT != got {
+				t.Errorf("expected RT: %s, but got: %s", test.wantRT, got)
+			}
+
+			// another tick with no time elapsed should not move R
+			vclock.Tick()
+			if got := vclock.RT(); test.wantRT != got {
+				t.Errorf("expected RT to stay at: %s, but got: %s", test.wantRT, got)
+			}
+		})
+	}
+}
+
+func TestRTClockAccumulates(t *testing.T) {
+	fakeClock := clocktesting.NewFakePassiveClock(time.Now())
+	seats, naQueues := 4, 2
+	vclock := NewRTClock(fakeClock, func() (int, int) {
+		return seats, naQueues
+	})
+
+	fakeClock.SetTime(fakeClock.Now().Add(time.Second))
+	vclock.Tick()
+
+	// the rate changes, the elapsed interval so far must be
+	// accounted for with the old rate
+	seats, naQueues = 3, 3
+	fakeClock.SetTime(fakeClock.Now().Add(time.Second))
+	vclock.Tick()
+
+	want := SeatsTimesDuration(2, time.Second) + SeatsTimesDuration(1, time.Second)
+	if got := vclock.RT(); want != got {
+		t.Errorf("expected RT: %s, but got: %s", want, got)
+	}
+}
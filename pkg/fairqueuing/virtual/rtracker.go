@@ -1,13 +1,25 @@
 package virtual
 
-func NewRTracker() rtracker {
-	return rtracker{}
+func NewRTracker() *rtracker {
+	return &rtracker{}
 }
 
+// RTracker records the virtual times of a request as it moves
+// through a queue set.
 type RTracker interface {
+	// OnStart is invoked when the request is enqueued, arrivalR is the
+	// virtual time at arrival, startR and finishR are the virtual
+	// times the request is expected to start and finish executing.
 	OnStart(arrivalR, startR, finishR SeatSeconds)
+
+	// OnDone is invoked with the virtual time at which the request
+	// left the queue set, either by finishing or by timing out.
 	OnDone(SeatSeconds)
+
+	ArrivalR() SeatSeconds
+	StartR() SeatSeconds
 	FinishR() SeatSeconds
+	DoneR() SeatSeconds
 }
 
 type rtracker struct {
@@ -15,16 +27,28 @@ type rtracker struct {
 	doneR                     SeatSeconds
 }
 
-func (t rtracker) OnStart(arrivalR, startR, finishR SeatSeconds) {
+func (t *rtracker) OnStart(arrivalR, startR, finishR SeatSeconds) {
 	t.arrivalR = arrivalR
 	t.startR = startR
 	t.finishR = finishR
 }
 
-func (t rtracker) OnDone(doneR SeatSeconds) {
+func (t *rtracker) OnDone(doneR SeatSeconds) {
 	t.doneR = doneR
 }
 
-func (t rtracker) FinishR() SeatSeconds {
+func (t *rtracker) ArrivalR() SeatSeconds {
+	return t.arrivalR
+}
+
+func (t *rtracker) StartR() SeatSeconds {
+	return t.startR
+}
+
+func (t *rtracker) FinishR() SeatSeconds {
 	return t.finishR
 }
+
+func (t *rtracker) DoneR() SeatSeconds {
+	return t.doneR
+}
@@ -0,0 +1,95 @@
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+)
+
+// PriorityLevels is implemented by the priority level controller
+type PriorityLevels interface {
+	Names() []string
+	Get(name string) (fairqueuing.FairQueueSet, bool)
+}
+
+// Dumper is implemented by the queuesets that can take a snapshot
+// of their state.
+type Dumper interface {
+	Dump() queueset.Dump
+}
+
+// NewHandler returns a handler that dumps the live state of the
+// queuesets of the given priority levels, the exempt levels are left
+// out. The dump is rendered as plain text, or as JSON if the query
+// parameter "format" is "json". Only the queues that have requests
+// waiting or executing are rendered, unless the query parameter
+// "all" is "true".
+func NewHandler(levels PriorityLevels) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		all := r.URL.Query().Get("all") == "true"
+		dumps := make([]queueset.Dump, 0)
+		for _, name := range levels.Names() {
+			qs, ok := levels.Get(name)
+			if !ok {
+				continue
+			}
+			dumper, ok := qs.(Dumper)
+			if !ok {
+				continue
+			}
+			dumps = append(dumps, filter(dumper.Dump(), all))
+		}
+
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(dumps)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, d := range dumps {
+			writeText(w, d)
+		}
+	})
+}
+
+func filter(d queueset.Dump, all bool) queueset.Dump {
+	if all {
+		return d
+	}
+	queues := d.Queues[:0]
+	for _, q := range d.Queues {
+		if q.Length > 0 || q.Seats.Total() > 0 {
+			queues = append(queues, q)
+		}
+	}
+	d.Queues = queues
+	return d
+}
+
+func writeText(w io.Writer, d queueset.Dump) {
+	fmt.Fprintf(w, "priority level: %s, seats: %d, virtual time: %.8f\n", d.Name, d.TotalSeats, d.VirtualTime)
+	if d.AdaptiveLimit > 0 {
+		fmt.Fprintf(w, "adaptive limit: %d seats\n", d.AdaptiveLimit)
+	}
+	fmt.Fprintf(w, "requests: executing=%d waiting=%d, seats: in use=%d waiting=%d\n",
+		d.Requests.Executing, d.Requests.Waiting, d.Seats.InUse, d.Seats.Waiting)
+	for _, q := range d.Queues {
+		var retired string
+		if q.Retired {
+			retired = " (retired)"
+		}
+		fmt.Fprintf(w, "  queue %d%s: length=%d seats: in use=%d waiting=%d, next finish R: %.8f\n",
+			q.ID, retired, q.Length, q.Seats.InUse, q.Seats.Waiting, q.NextFinishR)
+		for _, r := range q.Waiting {
+			fmt.Fprintf(w, "    %s: flow=%d seats=%d R=[%.8f, %.8f) waiting=%s\n",
+				r.Request, r.FlowID, r.Seats, r.StartR, r.FinishR, r.WaitTime)
+		}
+	}
+	fmt.Fprintln(w)
+}
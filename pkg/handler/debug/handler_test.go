@@ -0,0 +1,96 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/prioritylevel"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestDumpHandler(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	levels, err := prioritylevel.NewController(
+		prioritylevel.Config{Name: "exempt", Exempt: true},
+		prioritylevel.Config{Name: "catch-all", QueueSet: &queueset.Config{
+			TotalSeats: 1,
+			QueuingConfig: &queueset.QueuingConfig{
+				NQueues:        4,
+				QueueMaxLength: 128,
+			},
+			QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+			Clock:         fakeClock,
+			Events:        noopEvents{},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create priority levels: %v", err)
+	}
+
+	converter := apfhttp.NewConverter(fakeClock, nil, func(r *http.Request) (fairqueuing.FlowIDType, error) {
+		return fairqueuing.FlowIDType(len(r.URL.Path)), nil
+	}, func(*http.Request) (uint32, time.Duration, error) {
+		return 1, time.Second, nil
+	})
+	qs, _ := levels.Get("catch-all")
+	for _, path := range []string{"/a", "/bb", "/ccc"} {
+		r, _ := converter.Convert(httptest.NewRequest(http.MethodGet, path, nil))
+		if _, err := qs.EnqueueAndDispatch(r); err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+	}
+	fakeClock.Step(2 * time.Second)
+
+	handler := NewHandler(levels)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/apf", nil))
+	text := w.Body.String()
+	for _, want := range []string{
+		"priority level: catch-all, seats: 1, virtual time: 0.66666667",
+		"requests: executing=1 waiting=2",
+		"queue 3: length=1 seats: in use=0 waiting=1",
+		`"/bb": flow=3 seats=1 R=[0.00000000, 1.00000000) waiting=2s`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "exempt") || strings.Contains(text, "queue 1:") {
+		t.Errorf("expected the exempt level and the idle queues to be left out:\n%s", text)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/apf?format=json&all=true", nil))
+	var dumps []queueset.Dump
+	if err := json.Unmarshal(w.Body.Bytes(), &dumps); err != nil {
+		t.Fatalf("failed to decode the json dump: %v", err)
+	}
+	if len(dumps) != 1 || len(dumps[0].Queues) != 4 || dumps[0].Requests.Waiting != 2 {
+		t.Fatalf("unexpected dump: %+v", dumps)
+	}
+	var waiting int
+	for _, q := range dumps[0].Queues {
+		waiting += len(q.Waiting)
+	}
+	if waiting != 2 {
+		t.Errorf("expected 2 waiting requests in the dump, but got: %d", waiting)
+	}
+}
+
+type noopEvents struct{}
+
+func (noopEvents) QueueSelected(fairqueuing.FairQueue, fairqueuing.Request)      {}
+func (noopEvents) Enqueued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (noopEvents) Dequeued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (noopEvents) DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType) {}
+func (noopEvents) Disposed(fairqueuing.Request)                                  {}
+func (noopEvents) Rejected(fairqueuing.Request, fairqueuing.RejectReason)        {}
@@ -0,0 +1,81 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/promise"
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+	"github.com/tkashem/apf/pkg/latencytracker"
+	"k8s.io/utils/clock"
+)
+
+// CostEstimatorFunc estimates the seats a call occupies, and how long
+// it executes for.
+type CostEstimatorFunc func(ctx context.Context, fullMethod string) (seats uint32, duration time.Duration, err error)
+type QueueWaitContextFunc func(ctx context.Context, fullMethod string) (context.Context, context.CancelFunc)
+
+type converter struct {
+	clock            clock.PassiveClock
+	distinguisher    FlowDistinguisherFunc
+	costEstimator    CostEstimatorFunc
+	queueWaitContext QueueWaitContextFunc
+}
+
+func NewConverter(clock clock.PassiveClock, queueWaitContext QueueWaitContextFunc, distinguisher FlowDistinguisherFunc, costEstimator CostEstimatorFunc) *converter {
+	return &converter{clock: clock, queueWaitContext: queueWaitContext, distinguisher: distinguisher, costEstimator: costEstimator}
+}
+
+func (c converter) Convert(ctx context.Context, fullMethod string) (fairqueuing.Request, error) {
+	seats, duration, err := c.costEstimator(ctx, fullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &request{
+		ctx:        ctx,
+		fullMethod: fullMethod,
+		flowID:     ComputeFlow(ctx, fullMethod, c.distinguisher),
+		seats:      seats,
+		duration:   duration,
+		RTracker:   virtual.NewRTracker(),
+		trackers: fairqueuing.LatencyTrackers{
+			QueueWait:                 latencytracker.NewLatencyTracker(c.clock),
+			PostDecisionExecutionWait: latencytracker.NewLatencyTracker(c.clock),
+			ExecutionDuration:         latencytracker.NewLatencyTracker(c.clock),
+			TotalDuration:             latencytracker.NewLatencyTracker(c.clock),
+		},
+	}
+	if c.queueWaitContext != nil {
+		r.ctx, r.cancel = c.queueWaitContext(ctx, fullMethod)
+	}
+	r.DecisionWaiterSetter = promise.New(r.ctx)
+
+	return r, nil
+}
+
+type request struct {
+	fairqueuing.DecisionWaiterSetter
+	virtual.RTracker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	fullMethod string
+
+	seats    uint32
+	duration time.Duration
+	flowID   fairqueuing.FlowIDType
+	trackers fairqueuing.LatencyTrackers
+}
+
+func (r *request) Context() context.Context          { return r.ctx }
+func (r *request) CancelFunc() context.CancelFunc    { return r.cancel }
+func (r *request) GetFlowID() fairqueuing.FlowIDType { return r.flowID }
+func (r *request) EstimateCost() (seats uint32, width virtual.SeatSeconds) {
+	return r.seats, virtual.SeatsTimesDuration(float64(r.seats), r.duration)
+}
+func (r *request) LatencyTrackers() fairqueuing.LatencyTrackers { return r.trackers }
+func (r *request) String() string                               { return fmt.Sprintf("%q", r.fullMethod) }
@@ -0,0 +1,87 @@
+package grpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// FlowDistinguisherFunc returns the strings that tell the flow of a
+// call apart, given the context of the call and its full method name.
+type FlowDistinguisherFunc func(ctx context.Context, fullMethod string) []string
+
+// ByMethod distinguishes the flows by the full method name of the call.
+func ByMethod() FlowDistinguisherFunc {
+	return func(_ context.Context, fullMethod string) []string {
+		return []string{fullMethod}
+	}
+}
+
+// ByMetadata distinguishes the flows by the values of the given key
+// in the incoming metadata of the call.
+func ByMetadata(key string) FlowDistinguisherFunc {
+	return func(ctx context.Context, _ string) []string {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return nil
+		}
+		return md.Get(key)
+	}
+}
+
+// ByPeer distinguishes the flows by the host of the peer of the call,
+// the port is left out so the connections of a client share a flow.
+func ByPeer() FlowDistinguisherFunc {
+	return func(ctx context.Context, _ string) []string {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return nil
+		}
+		addr := p.Addr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		return []string{addr}
+	}
+}
+
+// Distinguishers concatenates the distinguishers of the given funcs,
+// in order.
+func Distinguishers(fns ...FlowDistinguisherFunc) FlowDistinguisherFunc {
+	return func(ctx context.Context, fullMethod string) []string {
+		var distinguishers []string
+		for _, fn := range fns {
+			distinguishers = append(distinguishers, fn(ctx, fullMethod)...)
+		}
+		return distinguishers
+	}
+}
+
+// ComputeFlow hashes the distinguishers of a call into its flow ID, it
+// hashes the same way as the http handler does, so a client that is
+// distinguished alike by both lands in the same flow.
+func ComputeFlow(ctx context.Context, fullMethod string, distinguisherFn FlowDistinguisherFunc) fairqueuing.FlowIDType {
+	if distinguisherFn == nil {
+		return 0
+	}
+	distinguishers := distinguisherFn(ctx, fullMethod)
+	if len(distinguishers) == 0 {
+		return 0
+	}
+
+	hash := sha256.New()
+	var sep = [1]byte{0}
+	for _, distinguisher := range distinguishers {
+		hash.Write([]byte(distinguisher))
+		hash.Write(sep[:])
+	}
+
+	var sum [32]byte
+	hash.Sum(sum[:0])
+	return fairqueuing.FlowIDType(binary.LittleEndian.Uint64(sum[:8]))
+}
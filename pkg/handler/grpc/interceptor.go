@@ -0,0 +1,192 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// defaultRetryAfter is the retry hint of a rejected call when the
+// dispatcher does not give one.
+const defaultRetryAfter = time.Second
+
+type Exempt interface {
+	IsExempt(ctx context.Context, fullMethod string) (bool, error)
+}
+
+type Converter interface {
+	Convert(ctx context.Context, fullMethod string) (fairqueuing.Request, error)
+}
+
+type EnqueueAndDispatcher interface {
+	EnqueueAndDispatch(fairqueuing.Request) (fairqueuing.Finisher, error)
+}
+
+// Classifier decides which priority level a call belongs to
+type Classifier interface {
+	Classify(ctx context.Context, fullMethod string) (level string, err error)
+}
+
+type ClassifierFunc func(ctx context.Context, fullMethod string) (string, error)
+
+func (f ClassifierFunc) Classify(ctx context.Context, fullMethod string) (string, error) {
+	return f(ctx, fullMethod)
+}
+
+// PriorityLevels returns the queueset of a priority level by its name
+type PriorityLevels interface {
+	Get(level string) (fairqueuing.FairQueueSet, bool)
+}
+
+// RetryAfterHinter is implemented by a finisher that can tell how long
+// its call, if it has been rejected while waiting in queue, should
+// wait before it is retried. The hint for a call that is rejected on
+// arrival is given by the RejectedError.
+type RetryAfterHinter interface {
+	RetryAfter() time.Duration
+}
+
+type Config struct {
+	// Exempt is optional, no call is exempt if it is not specified.
+	Exempt    Exempt
+	Converter Converter
+
+	// Classifier and PriorityLevels are optional, if specified, each
+	// call is dispatched by the queueset of the priority level it is
+	// classified to, instead of the dispatcher of the interceptor.
+	Classifier     Classifier
+	PriorityLevels PriorityLevels
+
+	// RetryAfterJitter, if positive, is the upper bound of a random
+	// delay that is added to the retry hint of a rejected call, so
+	// the rejected clients do not retry in lockstep.
+	RetryAfterJitter time.Duration
+}
+
+// NewUnaryServerInterceptor returns an interceptor that subjects the
+// unary calls to fair queuing, dispatcher can be nil if a Classifier
+// is configured.
+func NewUnaryServerInterceptor(dispatcher EnqueueAndDispatcher, c *Config) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var resp interface{}
+		var err error
+		if admitErr := admit(ctx, info.FullMethod, dispatcher, c, func() {
+			resp, err = handler(ctx, req)
+		}); admitErr != nil {
+			return nil, admitErr
+		}
+		return resp, err
+	}
+}
+
+// NewStreamServerInterceptor returns an interceptor that subjects the
+// streams to fair queuing, a stream occupies its seats until the
+// handler returns.
+func NewStreamServerInterceptor(dispatcher EnqueueAndDispatcher, c *Config) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		var err error
+		if admitErr := admit(ss.Context(), info.FullMethod, dispatcher, c, func() {
+			err = handler(srv, ss)
+		}); admitErr != nil {
+			return admitErr
+		}
+		return err
+	}
+}
+
+// admit runs serve if the call is exempt, or once the call is
+// dispatched, it returns the status error of the call otherwise.
+func admit(ctx context.Context, fullMethod string, dispatcher EnqueueAndDispatcher, c *Config, serve func()) error {
+	if c.Exempt != nil {
+		exempt, err := c.Exempt.IsExempt(ctx, fullMethod)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if exempt {
+			serve()
+			return nil
+		}
+	}
+
+	r, err := c.Converter.Convert(ctx, fullMethod)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if cancel := r.CancelFunc(); cancel != nil {
+		defer cancel()
+	}
+
+	d := dispatcher
+	if c.Classifier != nil {
+		level, err := c.Classifier.Classify(ctx, fullMethod)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		qs, ok := c.PriorityLevels.Get(level)
+		if !ok {
+			return status.Errorf(codes.Internal, "no priority level named %q", level)
+		}
+		d = qs
+	}
+
+	finisher, err := d.EnqueueAndDispatch(r)
+	if err != nil {
+		var rejected *fairqueuing.RejectedError
+		if errors.As(err, &rejected) {
+			return rejectedStatus(rejected.Reason, rejected.RetryAfter, c.RetryAfterJitter).Err()
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	var served bool
+	finisher.Finish(func() {
+		served = true
+		serve()
+	})
+	if !served {
+		var retryAfter time.Duration
+		if hinter, ok := finisher.(RetryAfterHinter); ok {
+			retryAfter = hinter.RetryAfter()
+		}
+		return rejectedStatus(r.RejectReason(), retryAfter, c.RetryAfterJitter).Err()
+	}
+	return nil
+}
+
+// rejectedStatus maps the reason a call was rejected for to its
+// status, a client that may retry is given the retry hint of the
+// dispatcher in a RetryInfo detail, or defaultRetryAfter if there is
+// none.
+func rejectedStatus(reason fairqueuing.RejectReason, retryAfter time.Duration, jitter time.Duration) *status.Status {
+	var s *status.Status
+	switch reason {
+	case fairqueuing.RejectCancelledByClient:
+		// the client is gone, there is nobody to retry
+		return status.New(codes.Canceled, fmt.Sprintf("rejected (%s)", reason))
+	case fairqueuing.RejectShuttingDown:
+		// the server is going away, the client should try another one
+		s = status.New(codes.Unavailable, "the server is shutting down, please try again later")
+	default:
+		s = status.New(codes.ResourceExhausted, fmt.Sprintf("too many requests (%s), please try again later", reason))
+	}
+
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	if jitter > 0 {
+		retryAfter += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	if detailed, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		s = detailed
+	}
+	return s
+}
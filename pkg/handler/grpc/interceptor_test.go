@@ -0,0 +1,230 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/utils/clock"
+)
+
+func TestUnaryInterceptor(t *testing.T) {
+	enqueuedCh := make(chan struct{}, 2)
+	qs := newQueueSet(t, queuingEvents{enqueuedCh: enqueuedCh})
+
+	// the blocked calls hold their seat until released
+	startedCh, releaseCh := make(chan struct{}), make(chan struct{})
+	blocker := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("block")) > 0 {
+			close(startedCh)
+			<-releaseCh
+		}
+		return handler(ctx, req)
+	}
+	client := newTestClient(t, grpc.ChainUnaryInterceptor(NewUnaryServerInterceptor(qs, newTestConfig(time.Minute)), blocker))
+
+	check := func(ctx context.Context, errCh chan<- error) {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		errCh <- err
+	}
+	firstErrCh, secondErrCh := make(chan error, 1), make(chan error, 1)
+	go check(metadata.AppendToOutgoingContext(context.Background(), "block", "true"), firstErrCh)
+	<-startedCh
+	<-enqueuedCh
+	go check(context.Background(), secondErrCh)
+	<-enqueuedCh
+
+	// the only seat is occupied and the queue is full
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	s := status.Convert(err)
+	if s.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected the third call to be rejected with %s, but got: %v", codes.ResourceExhausted, err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = info
+		}
+	}
+	if retryInfo == nil || retryInfo.GetRetryDelay().AsDuration() <= 0 {
+		t.Errorf("expected the rejected call to carry a retry delay, but got details: %v", s.Details())
+	}
+
+	close(releaseCh)
+	for name, errCh := range map[string]chan error{"first": firstErrCh, "second": secondErrCh} {
+		if err := <-errCh; err != nil {
+			t.Errorf("expected the %s call to be served, but got: %v", name, err)
+		}
+	}
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	qs := newQueueSet(t, queuingEvents{})
+	client := newTestClient(t, grpc.StreamInterceptor(NewStreamServerInterceptor(qs, newTestConfig(100*time.Millisecond))))
+
+	watch := func(ctx context.Context) error {
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+
+	// the first stream holds the only seat for as long as it is open
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	if err := watch(firstCtx); err != nil {
+		t.Fatalf("expected the first stream to be served, but got: %v", err)
+	}
+
+	if err := watch(context.Background()); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the second stream to time out in queue, but got: %v", err)
+	}
+
+	cancelFirst()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		err := watch(ctx)
+		if err == nil {
+			break
+		}
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("expected the third stream to be served once the first is closed, but got: %v", err)
+		}
+	}
+}
+
+func TestFlowDistinguishers(t *testing.T) {
+	const method = "/grpc.health.v1.Health/Check"
+	call := func(user, addr string) context.Context {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("user", user))
+		return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1234}})
+	}
+
+	tests := []struct {
+		name          string
+		distinguisher FlowDistinguisherFunc
+		this, that    context.Context
+		sameFlow      bool
+	}{
+		{
+			name:          "same user, different peers",
+			distinguisher: ByMetadata("user"),
+			this:          call("alice", "10.0.0.1"),
+			that:          call("alice", "10.0.0.2"),
+			sameFlow:      true,
+		},
+		{
+			name:          "different users",
+			distinguisher: ByMetadata("user"),
+			this:          call("alice", "10.0.0.1"),
+			that:          call("bob", "10.0.0.1"),
+		},
+		{
+			name:          "same peer, different users",
+			distinguisher: ByPeer(),
+			this:          call("alice", "10.0.0.1"),
+			that:          call("bob", "10.0.0.1"),
+			sameFlow:      true,
+		},
+		{
+			name:          "same method and user, different peers",
+			distinguisher: Distinguishers(ByMethod(), ByMetadata("user"), ByPeer()),
+			this:          call("alice", "10.0.0.1"),
+			that:          call("alice", "10.0.0.2"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			this := ComputeFlow(test.this, method, test.distinguisher)
+			that := ComputeFlow(test.that, method, test.distinguisher)
+			if this == 0 || that == 0 {
+				t.Fatalf("expected the calls to be distinguished, but got flows: %d, %d", this, that)
+			}
+			if (this == that) != test.sameFlow {
+				t.Errorf("expected same flow: %t, but got flows: %d, %d", test.sameFlow, this, that)
+			}
+		})
+	}
+}
+
+func newQueueSet(t *testing.T, events queueset.Events) fairqueuing.FairQueueSet {
+	qs, err := queueset.NewQueueSet(&queueset.Config{
+		Clock: clock.RealClock{},
+		QueuingConfig: &queueset.QueuingConfig{
+			NQueues:        1,
+			HandSize:       1,
+			QueueMaxLength: 1,
+		},
+		TotalSeats:    1,
+		Events:        events,
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+	return qs
+}
+
+func newTestConfig(queueWait time.Duration) *Config {
+	return &Config{
+		Converter: NewConverter(clock.RealClock{}, func(ctx context.Context, _ string) (context.Context, context.CancelFunc) {
+			return context.WithTimeout(ctx, queueWait)
+		}, ByMethod(), func(context.Context, string) (uint32, time.Duration, error) {
+			return 1, time.Second, nil
+		}),
+	}
+}
+
+// newTestClient serves the health service with the given interceptor
+// on an in-process connection, and returns a client of it.
+func newTestClient(t *testing.T, interceptor grpc.ServerOption) healthpb.HealthClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(interceptor)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial the test server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+type queuingEvents struct {
+	enqueuedCh chan<- struct{}
+}
+
+func (e queuingEvents) QueueSelected(fairqueuing.FairQueue, fairqueuing.Request) {}
+func (e queuingEvents) Enqueued(fairqueuing.FairQueue, fairqueuing.Request) {
+	if e.enqueuedCh != nil {
+		e.enqueuedCh <- struct{}{}
+	}
+}
+func (e queuingEvents) Dequeued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (e queuingEvents) DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType) {}
+func (e queuingEvents) Disposed(fairqueuing.Request)                                  {}
+func (e queuingEvents) Rejected(fairqueuing.Request, fairqueuing.RejectReason)        {}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Classification describes the priority level, and the flow a request
+// has been classified to.
+type Classification struct {
+	PriorityLevel string
+	// Flow is the name of the flow the request matched
+	Flow string
+	// FlowDistinguisher is the value that tells apart the requests
+	// of the same flow, like the user name, it may be empty.
+	FlowDistinguisher string
+	FlowHash          FlowHashType
+}
+
+type FlowClassifierFunc func(*http.Request) (Classification, error)
+
+// Classified is implemented by a converted request that carries the
+// classification of the original request.
+type Classified interface {
+	Classification() Classification
+}
+
+// ResponseHeaders holds the names of the response headers the
+// classification of a request is written to, a header with an empty
+// name is not written.
+type ResponseHeaders struct {
+	PriorityLevel     string
+	Flow              string
+	FlowDistinguisher string
+	FlowHash          string
+}
+
+// DefaultResponseHeaders returns the response headers modeled after
+// the X-Kubernetes-PF-* headers of the kube-apiserver.
+func DefaultResponseHeaders() *ResponseHeaders {
+	return &ResponseHeaders{
+		PriorityLevel:     "X-APF-PriorityLevel",
+		Flow:              "X-APF-Flow",
+		FlowDistinguisher: "X-APF-FlowDistinguisher",
+		FlowHash:          "X-APF-FlowHash",
+	}
+}
+
+func (h *ResponseHeaders) write(w http.ResponseWriter, c Classification) {
+	if h == nil {
+		return
+	}
+
+	set := func(name, value string) {
+		if len(name) > 0 && len(value) > 0 {
+			w.Header().Set(name, value)
+		}
+	}
+	set(h.PriorityLevel, c.PriorityLevel)
+	set(h.Flow, c.Flow)
+	set(h.FlowDistinguisher, c.FlowDistinguisher)
+	if len(c.Flow) > 0 {
+		set(h.FlowHash, strconv.FormatUint(uint64(c.FlowHash), 16))
+	}
+}
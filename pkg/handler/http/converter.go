@@ -14,22 +14,71 @@ import (
 )
 
 type FlowGetterFunc func(*http.Request) (fairqueuing.FlowIDType, error)
+
+// CostEstimatorFunc estimates the seats a request occupies, and how long
+// it executes for; once the request finishes, the queueset corrects the
+// estimate with the time the request actually executed for.
 type CostEstimatorFunc func(*http.Request) (seats uint32, duration time.Duration, err error)
 type QueueWaitContextFunc func(*http.Request) (context.Context, context.CancelFunc)
 
+// AdditionalWorkFunc returns the work a request is charged for on top
+// of its estimated cost, as the seats it is charged for, and for how
+// long; a request that is not charged extra returns zero seats.
+type AdditionalWorkFunc func(*http.Request) (seats uint32, duration time.Duration)
+
+// InitialWidthFunc returns the seats a long-running request occupies
+// during its initial phase on top of its estimated seats, like a watch
+// that sends the initial events; a request that is not charged extra
+// returns zero.
+type InitialWidthFunc func(*http.Request) (seats uint32)
+
 type converter struct {
 	clock            clock.PassiveClock
 	flowGetter       FlowGetterFunc
+	flowClassifier   FlowClassifierFunc
 	costEstimator    CostEstimatorFunc
 	queueWaitContext QueueWaitContextFunc
+	additionalWork   AdditionalWorkFunc
+	initialWidth     InitialWidthFunc
 }
 
 func NewConverter(clock clock.PassiveClock, queueWaitContext QueueWaitContextFunc, flowGetter FlowGetterFunc, costEstimator CostEstimatorFunc) *converter {
 	return &converter{clock: clock, queueWaitContext: queueWaitContext, flowGetter: flowGetter, costEstimator: costEstimator}
 }
 
+// NewClassifyingConverter returns a converter whose requests carry
+// their classification, the flow hash of the classification is the
+// flow ID of the request.
+func NewClassifyingConverter(clock clock.PassiveClock, queueWaitContext QueueWaitContextFunc, flowClassifier FlowClassifierFunc, costEstimator CostEstimatorFunc) *converter {
+	return &converter{clock: clock, queueWaitContext: queueWaitContext, flowClassifier: flowClassifier, costEstimator: costEstimator}
+}
+
+// WithAdditionalWork charges the requests for the additional work the
+// given func returns, like the watches are charged for the events they
+// are sent once their initial phase is over.
+func (c *converter) WithAdditionalWork(fn AdditionalWorkFunc) *converter {
+	c.additionalWork = fn
+	return c
+}
+
+// WithInitialWidth charges the requests for the extra seats the given
+// func returns, they hold them until they are served, or until their
+// initial phase is over if they are long-running.
+func (c *converter) WithInitialWidth(fn InitialWidthFunc) *converter {
+	c.initialWidth = fn
+	return c
+}
+
 func (c converter) Convert(in *http.Request) (fairqueuing.Request, error) {
-	flowID, err := c.flowGetter(in)
+	var classification Classification
+	var flowID fairqueuing.FlowIDType
+	var err error
+	if c.flowClassifier != nil {
+		classification, err = c.flowClassifier(in)
+		flowID = fairqueuing.FlowIDType(classification.FlowHash)
+	} else {
+		flowID, err = c.flowGetter(in)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -38,13 +87,18 @@ func (c converter) Convert(in *http.Request) (fairqueuing.Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.initialWidth != nil {
+		seats += c.initialWidth(in)
+	}
 
 	r := &request{
-		req:      in,
-		flowID:   flowID,
-		seats:    seats,
-		duration: duration,
-		RTracker: virtual.NewRTracker(),
+		clock:          c.clock,
+		req:            in,
+		flowID:         flowID,
+		classification: classification,
+		seats:          seats,
+		duration:       duration,
+		RTracker:       virtual.NewRTracker(),
 		trackers: fairqueuing.LatencyTrackers{
 			QueueWait:                 latencytracker.NewLatencyTracker(c.clock),
 			PostDecisionExecutionWait: latencytracker.NewLatencyTracker(c.clock),
@@ -53,12 +107,25 @@ func (c converter) Convert(in *http.Request) (fairqueuing.Request, error) {
 		},
 	}
 
+	if c.additionalWork != nil {
+		seats, duration := c.additionalWork(in)
+		r.additionalWork = virtual.SeatsTimesDuration(float64(seats), duration)
+	}
+
 	ctx := in.Context()
 	if c.queueWaitContext != nil {
+		queued := in
+		if c.flowClassifier != nil {
+			// the queue wait policies reuse the classification
+			queued = withClassification(in, classification)
+		}
 		var cancel context.CancelFunc
-		ctx, cancel = c.queueWaitContext(in)
+		ctx, cancel = c.queueWaitContext(queued)
 		r.ctx = ctx
 		r.cancel = cancel
+		if deadline, ok := ctx.Deadline(); ok && ctx.Value(rejectEarlyKey{}) != nil {
+			r.waitBudget, r.budgetedAt, r.budgeted = time.Until(deadline), c.clock.Now(), true
+		}
 	}
 	r.DecisionWaiterSetter = promise.New(ctx)
 
@@ -71,13 +138,22 @@ type request struct {
 
 	ctx    context.Context
 	cancel context.CancelFunc
+	clock  clock.PassiveClock
 
 	req *http.Request
 
-	seats    uint32
-	duration time.Duration
-	flowID   fairqueuing.FlowIDType
-	trackers fairqueuing.LatencyTrackers
+	seats          uint32
+	duration       time.Duration
+	additionalWork virtual.SeatSeconds
+	// waitBudget is the time the request had left to wait in queue at
+	// budgetedAt, if it is budgeted.
+	waitBudget time.Duration
+	budgetedAt time.Time
+	budgeted   bool
+	flowID     fairqueuing.FlowIDType
+	trackers   fairqueuing.LatencyTrackers
+
+	classification Classification
 }
 
 func (r *request) Context() context.Context {
@@ -89,7 +165,9 @@ func (r *request) Context() context.Context {
 func (r *request) CancelFunc() context.CancelFunc    { return r.cancel }
 func (r *request) GetFlowID() fairqueuing.FlowIDType { return r.flowID }
 func (r *request) EstimateCost() (seats uint32, width virtual.SeatSeconds) {
-	return r.seats, virtual.SeatsTimesDuration(float64(r.seats), r.duration)
+	return r.seats, virtual.SeatsTimesDuration(float64(r.seats), r.duration) + r.additionalWork
 }
+func (r *request) AdditionalWork() virtual.SeatSeconds          { return r.additionalWork }
+func (r *request) Classification() Classification               { return r.classification }
 func (r *request) LatencyTrackers() fairqueuing.LatencyTrackers { return r.trackers }
 func (r *request) String() string                               { return fmt.Sprintf("%q", r.req.URL) }
@@ -3,6 +3,8 @@ package http
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
 )
 
 func NewDefaultErrorHandler() *errorHandler {
@@ -34,10 +36,19 @@ type defaultEvents struct{}
 
 func (d defaultEvents) OnServed(w http.ResponseWriter, _ *http.Request) {}
 
-func (d defaultEvents) OnRejected(w http.ResponseWriter, _ *http.Request) {
+func (d defaultEvents) OnRejected(w http.ResponseWriter, _ *http.Request, reason fairqueuing.RejectReason) {
+	// the handler sets the hint of the queueset, if there is one
+	if w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", "1")
+	}
+	if reason == fairqueuing.RejectShuttingDown {
+		// the server is going away, the client should try another one
+		http.Error(w, "The server is shutting down, please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Return a 429 status indicating "Too Many Requests"
-	w.Header().Set("Retry-After", "1")
-	http.Error(w, "Too many requests, please try again later.", http.StatusTooManyRequests)
+	http.Error(w, fmt.Sprintf("Too many requests (%s), please try again later.", reason), http.StatusTooManyRequests)
 }
 
 func (d defaultEvents) OnExempt(w http.ResponseWriter, r *http.Request) {}
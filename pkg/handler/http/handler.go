@@ -2,7 +2,13 @@ package http
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/tkashem/apf/pkg/fairqueuing"
 	"k8s.io/utils/clock"
@@ -23,7 +29,9 @@ type ErrorHandler interface {
 type Events interface {
 	Arrived(*http.Request)
 	OnServed(http.ResponseWriter, *http.Request)
-	OnRejected(http.ResponseWriter, *http.Request)
+	// OnRejected is invoked when the request is not served, either
+	// because it was rejected on arrival, or while waiting in queue.
+	OnRejected(http.ResponseWriter, *http.Request, fairqueuing.RejectReason)
 	OnExempt(http.ResponseWriter, *http.Request)
 }
 
@@ -35,16 +43,76 @@ type EnqueueAndDispatcher interface {
 	EnqueueAndDispatch(fairqueuing.Request) (fairqueuing.Finisher, error)
 }
 
+// Classifier decides which priority level a request belongs to
+type Classifier interface {
+	Classify(*http.Request) (level string, err error)
+}
+
+type ClassifierFunc func(*http.Request) (string, error)
+
+func (f ClassifierFunc) Classify(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// PriorityLevels returns the queueset of a priority level by its name
+type PriorityLevels interface {
+	Get(level string) (fairqueuing.FairQueueSet, bool)
+}
+
+// RetryAfterHinter is implemented by a finisher that can tell how long
+// its request, if it has been rejected while waiting in queue, should
+// wait before it is retried. The hint for a request that is rejected
+// on arrival is given by the RejectedError.
+type RetryAfterHinter interface {
+	RetryAfter() time.Duration
+}
+
 type Config struct {
 	Exempt       Exempt
 	ErrorHandler ErrorHandler
 	Events       Events
 	Clock        clock.Clock
 	Converter    Converter
+
+	// ContextTransformer, if specified, derives the context of each
+	// request before it is evaluated, like to pin the configuration
+	// the request is evaluated against.
+	ContextTransformer ContextTransformer
+
+	// Classifier and PriorityLevels are optional, if specified, each
+	// request is dispatched by the queueset of the priority level it
+	// is classified to, instead of the dispatcher of the handler.
+	Classifier     Classifier
+	PriorityLevels PriorityLevels
+
+	// ResponseHeaders, if specified, names the headers the priority
+	// level and the flow of a request are written to, on both the
+	// served and the rejected responses.
+	ResponseHeaders *ResponseHeaders
+
+	// RetryAfterJitter, if positive, is the upper bound of a random
+	// delay that is added to the retry hint of a rejected request, so
+	// the rejected clients do not retry in lockstep.
+	RetryAfterJitter time.Duration
+
+	// LongRunning, if specified, tells the long-running requests, they
+	// release their seats once they call SignalInitialized. Their
+	// converter can charge them extra seats during their initial phase,
+	// see WithInitialWidth, and for the work they do afterwards, see
+	// WithAdditionalWork.
+	LongRunning LongRunningFunc
 }
 
+// NewAPFHandler returns a handler that subjects the requests to fair
+// queuing, dispatcher can be nil if a Classifier is configured.
 func NewAPFHandler(inner http.Handler, dispatcher EnqueueAndDispatcher, c *Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.ContextTransformer != nil {
+			ctx, cancel := c.ContextTransformer.Derive(r)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
 		e := c.Events
 		e.Arrived(r)
 
@@ -68,22 +136,83 @@ func NewAPFHandler(inner http.Handler, dispatcher EnqueueAndDispatcher, c *Confi
 			defer cancel()
 		}
 
-		finisher, err := dispatcher.EnqueueAndDispatch(fqr)
+		var classification Classification
+		if classified, ok := fqr.(Classified); ok {
+			classification = classified.Classification()
+		}
+
+		d := dispatcher
+		if c.Classifier != nil {
+			level, err := c.Classifier.Classify(r)
+			if err != nil {
+				c.ErrorHandler.HandleError(w, r, err)
+				return
+			}
+			classification.PriorityLevel = level
+			qs, ok := c.PriorityLevels.Get(level)
+			if !ok {
+				c.ErrorHandler.HandleError(w, r, fmt.Errorf("no priority level named %q", level))
+				return
+			}
+			d = qs
+		}
+		// the headers have to be in place before the inner handler
+		// writes the response.
+		c.ResponseHeaders.write(w, classification)
+
+		finisher, err := d.EnqueueAndDispatch(fqr)
 		if err != nil {
+			var rejected *fairqueuing.RejectedError
+			if errors.As(err, &rejected) {
+				setRetryAfter(w, rejected.RetryAfter, c.RetryAfterJitter)
+				e.OnRejected(w, r, rejected.Reason)
+				return
+			}
 			c.ErrorHandler.HandleError(w, r, err)
 			return
 		}
 
+		longRunning := c.LongRunning != nil && c.LongRunning(r)
 		var served bool
+		var wait func()
 		finisher.Finish(func() {
 			served = true
+			if longRunning {
+				wait = serveLongRunning(inner, w, r)
+				return
+			}
 			inner.ServeHTTP(w, r)
 		})
 
 		if !served {
-			e.OnRejected(w, r)
+			if hinter, ok := finisher.(RetryAfterHinter); ok {
+				setRetryAfter(w, hinter.RetryAfter(), c.RetryAfterJitter)
+			}
+			e.OnRejected(w, r, fqr.RejectReason())
 			return
 		}
+		if wait != nil {
+			// the seats are released, the request is still being served
+			wait()
+		}
 		e.OnServed(w, r)
 	})
 }
+
+// setRetryAfter sets the Retry-After header of the response to the
+// given retry hint of the dispatcher, if it gives one, the header is
+// left for the Events to set otherwise.
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration, jitter time.Duration) {
+	if retryAfter <= 0 {
+		return
+	}
+
+	if jitter > 0 {
+		retryAfter += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/prioritylevel"
 	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
 	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
 	"k8s.io/utils/clock"
@@ -116,6 +118,253 @@ func TestSchedulerWithQueuing(t *testing.T) {
 	}
 }
 
+func TestSchedulerWithPriorityLevels(t *testing.T) {
+	clock := clock.RealClock{}
+	newQueueSetConfig := func() *queueset.Config {
+		return &queueset.Config{
+			Clock: clock,
+			QueuingConfig: &queueset.QueuingConfig{
+				NQueues:        8,
+				HandSize:       2,
+				QueueMaxLength: 128,
+			},
+			TotalSeats: 1,
+			Events:     queuingEvents{t: t},
+		}
+	}
+	levels, err := prioritylevel.NewController(
+		prioritylevel.Config{Name: "exempt", Exempt: true},
+		prioritylevel.Config{Name: "workload-high", QueueSet: newQueueSetConfig()},
+		prioritylevel.Config{Name: "catch-all", QueueSet: newQueueSetConfig()},
+	)
+	if err != nil {
+		t.Fatalf("failed to create priority levels: %v", err)
+	}
+
+	converter := NewConverter(clock, func(r *http.Request) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(r.Context(), 3*time.Second)
+	}, func(*http.Request) (fairqueuing.FlowIDType, error) {
+		return 0, nil
+	}, func(*http.Request) (seats uint32, duration time.Duration, err error) {
+		return 1, time.Second, nil
+	})
+
+	blockedInProgressCh, blockedCh := make(chan struct{}), make(chan struct{})
+	requestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" {
+			close(blockedInProgressCh)
+			<-blockedCh
+		}
+	})
+	handler := NewAPFHandler(requestHandler, nil, &Config{
+		Exempt:       NewNoExemption(),
+		ErrorHandler: NewDefaultErrorHandler(),
+		Events:       NewDefaultEvents(),
+		Clock:        clock,
+		Converter:    converter,
+		Classifier: ClassifierFunc(func(r *http.Request) (string, error) {
+			switch r.URL.Path {
+			case "/healthz":
+				return "exempt", nil
+			case "/high":
+				return "workload-high", nil
+			case "/unknown":
+				return "unknown", nil
+			}
+			return "catch-all", nil
+		}),
+		PriorityLevels: levels,
+	})
+
+	blockedDoneCh := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/blocked", nil))
+		blockedDoneCh <- w.Code
+	}()
+	<-blockedInProgressCh
+
+	// the only seat of the catch-all level is occupied, the other
+	// levels should not be affected.
+	for path, want := range map[string]int{
+		"/healthz": http.StatusOK,
+		"/high":    http.StatusOK,
+		"/other":   http.StatusTooManyRequests,
+		"/unknown": http.StatusInternalServerError,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("[%s]: expected status code: %d, but got: %d", path, want, w.Code)
+		}
+	}
+
+	close(blockedCh)
+	if code := <-blockedDoneCh; code != http.StatusOK {
+		t.Errorf("[/blocked]: expected status code: %d, but got: %d", http.StatusOK, code)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		jitter   time.Duration
+		min, max int
+	}{
+		{name: "without jitter", min: 10, max: 10},
+		{name: "with jitter", jitter: 5 * time.Second, min: 10, max: 15},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := clock.RealClock{}
+			events := enqueuedEvents{queuingEvents: queuingEvents{t: t}, enqueuedCh: make(chan struct{}, 2)}
+			qs, err := queueset.NewQueueSet(&queueset.Config{
+				Clock: clock,
+				QueuingConfig: &queueset.QueuingConfig{
+					NQueues:        1,
+					QueueMaxLength: 1,
+				},
+				TotalSeats:    1,
+				Events:        events,
+				QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+			})
+			if err != nil {
+				t.Fatalf("failed to create queueset: %v", err)
+			}
+
+			converter := NewConverter(clock, func(r *http.Request) (context.Context, context.CancelFunc) {
+				return context.WithCancel(r.Context())
+			}, func(*http.Request) (fairqueuing.FlowIDType, error) {
+				return 0, nil
+			}, func(*http.Request) (seats uint32, duration time.Duration, err error) {
+				return 1, 10 * time.Second, nil
+			})
+
+			blockedInProgressCh, blockedCh := make(chan struct{}), make(chan struct{})
+			handler := NewAPFHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/blocked" {
+					close(blockedInProgressCh)
+					<-blockedCh
+				}
+			}), qs, &Config{
+				Exempt:           NewNoExemption(),
+				ErrorHandler:     NewDefaultErrorHandler(),
+				Events:           NewDefaultEvents(),
+				Clock:            clock,
+				Converter:        converter,
+				RetryAfterJitter: test.jitter,
+			})
+
+			// the first request occupies the only seat, the second one
+			// waits in the queue, and fills it.
+			doneCh := make(chan struct{}, 2)
+			for _, path := range []string{"/blocked", "/waiting"} {
+				go func(path string) {
+					defer func() { doneCh <- struct{}{} }()
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+				}(path)
+				<-events.enqueuedCh
+			}
+			<-blockedInProgressCh
+			defer func() {
+				close(blockedCh)
+				<-doneCh
+				<-doneCh
+			}()
+
+			for i := 0; i < 10; i++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rejected", nil))
+				if w.Code != http.StatusTooManyRequests {
+					t.Fatalf("expected status code: %d, but got: %d", http.StatusTooManyRequests, w.Code)
+				}
+				seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+				if err != nil || seconds < test.min || seconds > test.max {
+					t.Errorf("expected Retry-After in [%d, %d], but got: %q", test.min, test.max, w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	clock := clock.RealClock{}
+	levels, err := prioritylevel.NewController(prioritylevel.Config{
+		Name: "catch-all",
+		QueueSet: &queueset.Config{
+			Clock: clock,
+			QueuingConfig: &queueset.QueuingConfig{
+				NQueues:        1,
+				HandSize:       1,
+				QueueMaxLength: 0,
+			},
+			TotalSeats: 1,
+			Events:     queuingEvents{t: t},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create priority levels: %v", err)
+	}
+
+	converter := NewClassifyingConverter(clock, nil, func(r *http.Request) (Classification, error) {
+		return Classification{Flow: "tenants", FlowDistinguisher: r.Header.Get("X-Tenant"), FlowHash: 0xbeef}, nil
+	}, func(*http.Request) (seats uint32, duration time.Duration, err error) {
+		return 1, time.Second, nil
+	})
+
+	blockedInProgressCh, blockedCh := make(chan struct{}), make(chan struct{})
+	handler := NewAPFHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" {
+			close(blockedInProgressCh)
+			<-blockedCh
+		}
+	}), nil, &Config{
+		Exempt:       NewNoExemption(),
+		ErrorHandler: NewDefaultErrorHandler(),
+		Events:       NewDefaultEvents(),
+		Clock:        clock,
+		Converter:    converter,
+		Classifier: ClassifierFunc(func(*http.Request) (string, error) {
+			return "catch-all", nil
+		}),
+		PriorityLevels:  levels,
+		ResponseHeaders: DefaultResponseHeaders(),
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Tenant", "red")
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	want := map[string]string{
+		"X-APF-PriorityLevel":     "catch-all",
+		"X-APF-Flow":              "tenants",
+		"X-APF-FlowDistinguisher": "red",
+		"X-APF-FlowHash":          "beef",
+	}
+
+	servedCh := make(chan *httptest.ResponseRecorder)
+	go func() { servedCh <- serve("/blocked") }()
+	<-blockedInProgressCh
+
+	// queuing is disabled, and the only seat is occupied
+	rejected := serve("/rejected")
+	close(blockedCh)
+	served := <-servedCh
+
+	for name, w := range map[string]*httptest.ResponseRecorder{"served": served, "rejected": rejected} {
+		for header, value := range want {
+			if got := w.Header().Get(header); got != value {
+				t.Errorf("[%s]: expected header %s: %q, but got: %q", name, header, value, got)
+			}
+		}
+	}
+	if rejected.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status code: %d, but got: %d", http.StatusTooManyRequests, rejected.Code)
+	}
+}
+
 type queuingEvents struct {
 	t *testing.T
 }
@@ -135,8 +384,18 @@ func (e queuingEvents) DecisionChanged(r fairqueuing.Request, d fairqueuing.Deci
 func (e queuingEvents) Disposed(r fairqueuing.Request) {
 	e.t.Logf("disposed: %q", r)
 }
-func (e queuingEvents) Timeout(r fairqueuing.Request) {
-	e.t.Logf("timeout: %q", r)
+func (e queuingEvents) Rejected(r fairqueuing.Request, reason fairqueuing.RejectReason) {
+	e.t.Logf("rejected: %q, reason: %s", r, reason)
+}
+
+type enqueuedEvents struct {
+	queuingEvents
+	enqueuedCh chan struct{}
+}
+
+func (e enqueuedEvents) Enqueued(q fairqueuing.FairQueue, r fairqueuing.Request) {
+	e.queuingEvents.Enqueued(q, r)
+	e.enqueuedCh <- struct{}{}
 }
 
 func check(resp *http.Response, err error, want int) error {
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// LongRunningFunc tells whether a request is long-running, like a
+// watch, a server-sent event stream, or a websocket upgrade. Such a
+// request goes through fair queuing to be admitted, and releases its
+// seats once its initial phase is over, instead of holding them for
+// as long as it is served.
+type LongRunningFunc func(*http.Request) bool
+
+// IsLongRunning is the LongRunningFunc that matches the watches, the
+// requests for an event stream, and the websocket upgrades.
+func IsLongRunning(r *http.Request) bool {
+	switch {
+	case r.URL.Query().Get("watch") == "true", r.URL.Query().Get("watch") == "1":
+		return true
+	case strings.Contains(r.Header.Get("Accept"), "text/event-stream"):
+		return true
+	}
+	for _, protocol := range strings.Split(r.Header.Get("Upgrade"), ",") {
+		if strings.EqualFold(strings.TrimSpace(protocol), "websocket") {
+			return true
+		}
+	}
+	return false
+}
+
+type initializedKey struct{}
+
+// SignalInitialized tells that the initial phase of the long-running
+// request of the given context is over, like the initial events of a
+// watch are sent, or the connection is upgraded. The seats of the
+// request are released, while its handler keeps serving it. A request
+// that never signals holds its seats until it is served.
+//
+// It is a no-op if the request is not long-running, or it is called
+// more than once.
+func SignalInitialized(ctx context.Context) {
+	if signal, ok := ctx.Value(initializedKey{}).(func()); ok {
+		signal()
+	}
+}
+
+// serveLongRunning starts serving a long-running request, it returns
+// once the request signals its initial phase is over, or once it is
+// served, whichever comes first. The returned func waits until the
+// request is served, and re-panics if the inner handler panicked.
+func serveLongRunning(inner http.Handler, w http.ResponseWriter, r *http.Request) (wait func()) {
+	initializedCh, doneCh := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	signal := func() {
+		once.Do(func() { close(initializedCh) })
+	}
+
+	var recovered interface{}
+	go func() {
+		defer close(doneCh)
+		defer func() {
+			recovered = recover()
+		}()
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), initializedKey{}, signal)))
+	}()
+
+	select {
+	case <-initializedCh:
+	case <-doneCh:
+	}
+	return func() {
+		<-doneCh
+		if recovered != nil {
+			panic(recovered)
+		}
+	}
+}
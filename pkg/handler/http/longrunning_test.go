@@ -0,0 +1,170 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+	"k8s.io/utils/clock"
+)
+
+func TestLongRunning(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		longRunning LongRunningFunc
+		signal      bool
+		// want is the status code of the request that arrives while
+		// the watch is being served.
+		want int
+	}{
+		{name: "released once initialized", longRunning: IsLongRunning, signal: true, want: http.StatusOK},
+		{name: "never initialized", longRunning: IsLongRunning, want: http.StatusTooManyRequests},
+		{name: "not long-running", signal: true, want: http.StatusTooManyRequests},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := clock.RealClock{}
+			qs, err := queueset.NewQueueSet(&queueset.Config{
+				Clock: clock,
+				QueuingConfig: &queueset.QueuingConfig{
+					NQueues:        1,
+					QueueMaxLength: 1,
+				},
+				TotalSeats:    1,
+				Events:        queuingEvents{t: t},
+				QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+			})
+			if err != nil {
+				t.Fatalf("failed to create queueset: %v", err)
+			}
+
+			converter := NewConverter(clock, func(r *http.Request) (context.Context, context.CancelFunc) {
+				return context.WithTimeout(r.Context(), 200*time.Millisecond)
+			}, func(*http.Request) (fairqueuing.FlowIDType, error) {
+				return 0, nil
+			}, func(*http.Request) (seats uint32, duration time.Duration, err error) {
+				return 1, time.Second, nil
+			})
+
+			watchingCh, stopWatchCh := make(chan struct{}), make(chan struct{})
+			handler := NewAPFHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("watch") != "true" {
+					return
+				}
+				if test.signal {
+					SignalInitialized(r.Context())
+				}
+				close(watchingCh)
+				<-stopWatchCh
+			}), qs, &Config{
+				Exempt:       NewNoExemption(),
+				ErrorHandler: NewDefaultErrorHandler(),
+				Events:       NewDefaultEvents(),
+				Clock:        clock,
+				Converter:    converter,
+				LongRunning:  test.longRunning,
+			})
+
+			watchCh := make(chan int, 1)
+			go func() {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pods?watch=true", nil))
+				watchCh <- w.Code
+			}()
+			<-watchingCh
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pods", nil))
+			if w.Code != test.want {
+				t.Errorf("expected status code: %d, but got: %d", test.want, w.Code)
+			}
+
+			close(stopWatchCh)
+			if code := <-watchCh; code != http.StatusOK {
+				t.Errorf("expected the watch to be served, but got status code: %d", code)
+			}
+		})
+	}
+}
+
+func TestAdditionalWork(t *testing.T) {
+	converter := NewConverter(clock.RealClock{}, nil, func(*http.Request) (fairqueuing.FlowIDType, error) {
+		return 0, nil
+	}, func(*http.Request) (seats uint32, duration time.Duration, err error) {
+		return 2, time.Second, nil
+	}).WithAdditionalWork(func(r *http.Request) (uint32, time.Duration) {
+		if IsLongRunning(r) {
+			return 1, time.Minute
+		}
+		return 0, 0
+	})
+
+	for path, want := range map[string]virtual.SeatSeconds{
+		"/pods":            virtual.SeatsTimesDuration(2, time.Second),
+		"/pods?watch=true": virtual.SeatsTimesDuration(2, time.Second) + virtual.SeatsTimesDuration(1, time.Minute),
+	} {
+		r, err := converter.Convert(httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatalf("failed to convert request %q: %v", path, err)
+		}
+		if _, width := r.EstimateCost(); width != want {
+			t.Errorf("request %q: expected width: %s, but got: %s", path, want, width)
+		}
+	}
+}
+
+func TestInitialWidth(t *testing.T) {
+	converter := NewConverter(clock.RealClock{}, nil, func(*http.Request) (fairqueuing.FlowIDType, error) {
+		return 0, nil
+	}, func(*http.Request) (seats uint32, duration time.Duration, err error) {
+		return 1, time.Second, nil
+	}).WithInitialWidth(func(r *http.Request) uint32 {
+		if IsLongRunning(r) {
+			return 3
+		}
+		return 0
+	})
+
+	for path, want := range map[string]uint32{
+		"/pods":            1,
+		"/pods?watch=true": 4,
+	} {
+		r, err := converter.Convert(httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatalf("failed to convert request %q: %v", path, err)
+		}
+		if seats, width := r.EstimateCost(); seats != want || width != virtual.SeatsTimesDuration(float64(want), time.Second) {
+			t.Errorf("request %q: expected %d seats for 1s, but got: %d seats, width: %s", path, want, seats, width)
+		}
+	}
+}
+
+func TestIsLongRunning(t *testing.T) {
+	for _, test := range []struct {
+		path    string
+		headers map[string]string
+		want    bool
+	}{
+		{path: "/pods", want: false},
+		{path: "/pods?watch=true", want: true},
+		{path: "/pods?watch=1", want: true},
+		{path: "/pods?watch=false", want: false},
+		{path: "/events", headers: map[string]string{"Accept": "text/event-stream"}, want: true},
+		{path: "/exec", headers: map[string]string{"Upgrade": "websocket"}, want: true},
+		{path: "/exec", headers: map[string]string{"Upgrade": "h2c, WebSocket"}, want: true},
+		{path: "/", headers: map[string]string{"Upgrade": "h2c"}, want: false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+		if got := IsLongRunning(r); got != test.want {
+			t.Errorf("request %q with headers %v: expected long-running: %t, but got: %t", test.path, test.headers, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+// QueueWaitFraction returns a QueueWaitContextFunc that lets a request
+// wait in queue for the given fraction, in the range (0, 1], of the
+// time left until the deadline of its context, so the handler has the
+// rest of the time to serve it. A request without a deadline may wait
+// as long as its context allows.
+func QueueWaitFraction(fraction float64) QueueWaitContextFunc {
+	return func(r *http.Request) (context.Context, context.CancelFunc) {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			return context.WithCancel(r.Context())
+		}
+		budget := time.Duration(float64(time.Until(deadline)) * fraction)
+		return context.WithTimeout(r.Context(), budget)
+	}
+}
+
+// MaxQueueWait returns a QueueWaitContextFunc that lets a request wait
+// in queue for at most the max wait of the priority level it is
+// classified to, or fallback if its level has none. A request may wait
+// as long as its context allows if neither is positive.
+//
+// The priority level of a request that has been classified by the
+// converter already is reused, the classifier is only consulted for
+// the requests that have not been.
+func MaxQueueWait(classifier Classifier, maxWaits map[string]time.Duration, fallback time.Duration) QueueWaitContextFunc {
+	return func(r *http.Request) (context.Context, context.CancelFunc) {
+		timeout := fallback
+		if len(maxWaits) == 0 {
+			return withTimeout(r.Context(), timeout)
+		}
+		level, ok := classifiedLevel(r)
+		if !ok {
+			// a request that can not be classified is not served,
+			// the handler reports the error.
+			level, _ = classifier.Classify(r)
+		}
+		if maxWait, ok := maxWaits[level]; ok && maxWait > 0 {
+			timeout = maxWait
+		}
+		return withTimeout(r.Context(), timeout)
+	}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+type classificationKey struct{}
+
+// withClassification returns the request with the given classification,
+// for the queue wait policies to reuse.
+func withClassification(r *http.Request, c Classification) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), classificationKey{}, c))
+}
+
+// classifiedLevel returns the priority level the request has been
+// classified to by the converter, if any.
+func classifiedLevel(r *http.Request) (string, bool) {
+	c, ok := r.Context().Value(classificationKey{}).(Classification)
+	if !ok || len(c.PriorityLevel) == 0 {
+		return "", false
+	}
+	return c.PriorityLevel, true
+}
+
+// ShortestQueueWait returns a QueueWaitContextFunc that applies each
+// of the given policies to a request, its queue wait context has the
+// earliest of their deadlines. The values the policies put in their
+// contexts are not carried over.
+func ShortestQueueWait(policies ...QueueWaitContextFunc) QueueWaitContextFunc {
+	return func(r *http.Request) (context.Context, context.CancelFunc) {
+		var earliest time.Time
+		for _, policy := range policies {
+			ctx, cancel := policy(r)
+			if deadline, ok := ctx.Deadline(); ok && (earliest.IsZero() || deadline.Before(earliest)) {
+				earliest = deadline
+			}
+			cancel()
+		}
+		if earliest.IsZero() {
+			return context.WithCancel(r.Context())
+		}
+		return context.WithDeadline(r.Context(), earliest)
+	}
+}
+
+type rejectEarlyKey struct{}
+
+var _ fairqueuing.WaitBudgeter = &request{}
+
+// RejectEarly wraps the given QueueWaitContextFunc, the time left until
+// the deadline of the queue wait context it derives is the wait budget
+// of the request: the queueset rejects the request on arrival if it is
+// expected to wait in queue for longer, instead of parking it only to
+// time out later.
+func RejectEarly(policy QueueWaitContextFunc) QueueWaitContextFunc {
+	return func(r *http.Request) (context.Context, context.CancelFunc) {
+		ctx, cancel := policy(r)
+		return context.WithValue(ctx, rejectEarlyKey{}, true), cancel
+	}
+}
+
+// WaitBudget returns the time left until the deadline of the queue wait
+// context of the request, if it was derived by RejectEarly. The deadline
+// is on the wall clock, like any context deadline, so the time left is
+// taken when the request is converted, and the time that has passed
+// since is measured with the clock of the converter, like the expected
+// wait of the queueset.
+func (r *request) WaitBudget() (time.Duration, bool) {
+	if !r.budgeted {
+		return 0, false
+	}
+	return r.waitBudget - r.clock.Since(r.budgetedAt), true
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestQueueWaitPolicies(t *testing.T) {
+	classifier := ClassifierFunc(func(r *http.Request) (string, error) {
+		return r.Header.Get("X-Level"), nil
+	})
+	maxWait := MaxQueueWait(classifier, map[string]time.Duration{"fast": time.Second}, 10*time.Second)
+
+	tests := []struct {
+		name     string
+		policy   QueueWaitContextFunc
+		level    string
+		deadline time.Duration
+		// want is the expected timeout of the queue wait context, zero
+		// if it should have no deadline.
+		want time.Duration
+	}{
+		{name: "fraction of the deadline", policy: QueueWaitFraction(0.25), deadline: 8 * time.Second, want: 2 * time.Second},
+		{name: "fraction without a deadline", policy: QueueWaitFraction(0.25)},
+		{name: "max wait of the level", policy: maxWait, level: "fast", want: time.Second},
+		{name: "fallback max wait", policy: maxWait, level: "slow", want: 10 * time.Second},
+		{name: "shortest wins", policy: ShortestQueueWait(maxWait, QueueWaitFraction(0.5)), level: "slow", deadline: 8 * time.Second, want: 4 * time.Second},
+		{name: "shortest without a deadline", policy: ShortestQueueWait(maxWait, QueueWaitFraction(0.5)), level: "fast", want: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Level", test.level)
+			if test.deadline > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), test.deadline)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+
+			ctx, cancel := test.policy(r)
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			switch {
+			case test.want == 0 && ok:
+				t.Errorf("expected no deadline, but got: %s", time.Until(deadline))
+			case test.want > 0 && !ok:
+				t.Errorf("expected a timeout of %s, but got no deadline", test.want)
+			case test.want > 0:
+				if got := time.Until(deadline); got > test.want || got < test.want-time.Second/2 {
+					t.Errorf("expected a timeout of %s, but got: %s", test.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxQueueWaitReusesClassification(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	var classified int
+	classifier := ClassifierFunc(func(*http.Request) (string, error) {
+		classified++
+		return "slow", nil
+	})
+	converter := NewClassifyingConverter(fakeClock,
+		MaxQueueWait(classifier, map[string]time.Duration{"fast": time.Second}, 10*time.Second),
+		func(*http.Request) (Classification, error) {
+			return Classification{PriorityLevel: "fast", Flow: "fast"}, nil
+		},
+		func(*http.Request) (uint32, time.Duration, error) { return 1, time.Second, nil })
+
+	r, err := converter.Convert(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("failed to convert the request: %v", err)
+	}
+	defer r.CancelFunc()()
+	if classified != 0 {
+		t.Errorf("expected the classifier not to be consulted, but it was %d times", classified)
+	}
+	if deadline, ok := r.Context().Deadline(); !ok || time.Until(deadline) > time.Second || time.Until(deadline) < time.Second/2 {
+		t.Errorf("expected the max wait of the classified level: %s, but got: %s", time.Second, time.Until(deadline))
+	}
+}
+
+func TestRejectEarly(t *testing.T) {
+	// the fake clock is far behind the wall clock, like that of the
+	// simulator, the deadlines of the contexts are on the wall clock
+	// nonetheless.
+	fakeClock := clocktesting.NewFakeClock(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC))
+	estimate := func(*http.Request) (uint32, time.Duration, error) { return 1, time.Second, nil }
+	flow := func(*http.Request) (fairqueuing.FlowIDType, error) { return 1, nil }
+	policy := MaxQueueWait(ClassifierFunc(func(*http.Request) (string, error) { return "", nil }), nil, 2*time.Second)
+
+	for _, rejectEarly := range []bool{false, true} {
+		queueWait := policy
+		if rejectEarly {
+			queueWait = RejectEarly(policy)
+		}
+		converter := NewConverter(fakeClock, queueWait, flow, estimate)
+		r, err := converter.Convert(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("failed to convert the request: %v", err)
+		}
+		defer r.CancelFunc()()
+		if err := r.Context().Err(); err != nil {
+			t.Errorf("expected the queue wait context to be alive, but got: %v", err)
+		}
+
+		budget, ok := r.(fairqueuing.WaitBudgeter).WaitBudget()
+		if ok != rejectEarly {
+			t.Errorf("expected the request to have a wait budget: %t, but got: %t", rejectEarly, ok)
+		}
+		if ok && (budget > 2*time.Second || budget < time.Second) {
+			t.Errorf("expected a wait budget close to %s, but got: %s", 2*time.Second, budget)
+		}
+
+		// the time the request spends in the queueset is measured with
+		// the clock of the converter.
+		fakeClock.Step(time.Second)
+		if budget, ok := r.(fairqueuing.WaitBudgeter).WaitBudget(); ok && (budget > time.Second || budget < 0) {
+			t.Errorf("expected a wait budget close to %s, but got: %s", time.Second, budget)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Shutdowner is implemented by a dispatcher that can be drained, like
+// a queueset, or the priority level controller.
+type Shutdowner interface {
+	Shutdown(context.Context) error
+}
+
+// RegisterOnShutdown arranges for the given dispatcher to be shut down
+// when the server is. The new requests are rejected, the requests that
+// are waiting in queue keep being dispatched, and those still waiting
+// after the given timeout are rejected, so the server does not wait
+// for them until their own timeout.
+func RegisterOnShutdown(server *http.Server, dispatcher Shutdowner, timeout time.Duration) {
+	server.RegisterOnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// the server does not wait for us, and the error only tells
+		// that the requests had to be rejected at the deadline.
+		_ = dispatcher.Shutdown(ctx)
+	})
+}
@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+)
+
+const namespace = "apf_"
+
+// New returns the metrics of the fair queuing filter
+func New() *Metrics {
+	r := &registry{}
+	return &Metrics{
+		registry: r,
+
+		executingRequests: r.gauge(namespace+"current_executing_requests", "Number of requests executing in a priority level.", "priority_level"),
+		waitingRequests:   r.gauge(namespace+"current_waiting_requests", "Number of requests waiting in the queues of a priority level.", "priority_level"),
+		executingSeats:    r.gauge(namespace+"current_executing_seats", "Number of seats occupied by the requests executing in a priority level.", "priority_level"),
+		waitingSeats:      r.gauge(namespace+"current_waiting_seats", "Number of seats requested by the requests waiting in a priority level.", "priority_level"),
+		adaptiveLimit:     r.gauge(namespace+"current_adaptive_limit_seats", "Number of seats the adaptive limiter of a priority level allows, 0 if it has none.", "priority_level"),
+
+		queueExecutingRequests: r.gauge(namespace+"queue_executing_requests", "Number of requests executing from a queue.", "priority_level", "queue"),
+		queueWaitingRequests:   r.gauge(namespace+"queue_waiting_requests", "Number of requests waiting in a queue.", "priority_level", "queue"),
+		queueExecutingSeats:    r.gauge(namespace+"queue_executing_seats", "Number of seats occupied by the requests executing from a queue.", "priority_level", "queue"),
+		queueWaitingSeats:      r.gauge(namespace+"queue_waiting_seats", "Number of seats requested by the requests waiting in a queue.", "priority_level", "queue"),
+
+		dispatched:       r.counter(namespace+"dispatched_requests_total", "Number of requests dispatched for execution.", "priority_level"),
+		rejectedRequests: r.counter(namespace+"rejected_requests_total", "Number of requests rejected on arrival, or while waiting in queue.", "priority_level", "reason"),
+
+		queueWait:                 r.histogram(namespace+"request_queue_wait_seconds", "Time a request spent waiting in its queue.", DefBuckets, "priority_level", "execute"),
+		postDecisionExecutionWait: r.histogram(namespace+"request_post_decision_wait_seconds", "Time from the decision to execute a request until its handler starts.", DefBuckets, "priority_level"),
+		execution:                 r.histogram(namespace+"request_execution_seconds", "Time the handler of a request took to execute.", DefBuckets, "priority_level"),
+		total:                     r.histogram(namespace+"request_total_duration_seconds", "Time from the arrival of a request until it is done.", DefBuckets, "priority_level", "execute"),
+
+		arrived:  r.counter(namespace+"http_arrived_requests_total", "Number of http requests that arrived at the filter."),
+		served:   r.counter(namespace+"http_served_requests_total", "Number of http requests that were served."),
+		rejected: r.counter(namespace+"http_rejected_requests_total", "Number of http requests that were rejected.", "reason"),
+		exempt:   r.counter(namespace+"http_exempt_requests_total", "Number of http requests that were exempt from fair queuing."),
+
+		queues: map[fairqueuing.Request]string{},
+	}
+}
+
+// Metrics keeps track of the state of the queuesets, and the http
+// filter. The queuesets report to it through the Events returned by
+// QueueSetEvents, and the http filter through HTTPEvents.
+type Metrics struct {
+	*registry
+
+	executingRequests, waitingRequests                     *metricVec
+	executingSeats, waitingSeats                           *metricVec
+	adaptiveLimit                                          *metricVec
+	queueExecutingRequests, queueWaitingRequests           *metricVec
+	queueExecutingSeats, queueWaitingSeats                 *metricVec
+	dispatched, rejectedRequests                           *metricVec
+	queueWait, postDecisionExecutionWait, execution, total *metricVec
+	arrived, served, rejected, exempt                      *metricVec
+
+	lock sync.Mutex
+	// queues tracks the queue of each request in a queueset, the
+	// events after Enqueued do not carry the queue.
+	queues map[fairqueuing.Request]string
+}
+
+// Handler serves the metrics in the prometheus text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return m.registry
+}
+
+// QueueSetEvents returns the Events for the queueset of the given
+// priority level.
+func (m *Metrics) QueueSetEvents(priorityLevel string) queueset.Events {
+	return &queueSetEvents{m: m, level: priorityLevel}
+}
+
+// HTTPEvents returns the Events for the http filter, each event is
+// counted and then passed on to the given delegate.
+func (m *Metrics) HTTPEvents(delegate apfhttp.Events) apfhttp.Events {
+	return &httpEvents{m: m, delegate: delegate}
+}
+
+func (m *Metrics) setQueue(r fairqueuing.Request, queue string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queues[r] = queue
+}
+
+func (m *Metrics) getQueue(r fairqueuing.Request, remove bool) string {
+	queue, _ := m.lookupQueue(r, remove)
+	return queue
+}
+
+// lookupQueue returns the queue of the given request, ok is false if
+// the request was never enqueued.
+func (m *Metrics) lookupQueue(r fairqueuing.Request, remove bool) (queue string, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	queue, ok = m.queues[r]
+	if remove {
+		delete(m.queues, r)
+	}
+	return queue, ok
+}
+
+var _ queueset.Events = &queueSetEvents{}
+var _ queueset.LimitEvents = &queueSetEvents{}
+
+type queueSetEvents struct {
+	m     *Metrics
+	level string
+}
+
+func (e *queueSetEvents) QueueSelected(fairqueuing.FairQueue, fairqueuing.Request) {}
+
+func (e *queueSetEvents) Enqueued(q fairqueuing.FairQueue, r fairqueuing.Request) {
+	m, queue := e.m, q.String()
+	m.setQueue(r, queue)
+
+	seats, _ := r.EstimateCost()
+	m.add(m.waitingRequests, 1, e.level)
+	m.add(m.waitingSeats, float64(seats), e.level)
+	m.add(m.queueWaitingRequests, 1, e.level, queue)
+	m.add(m.queueWaitingSeats, float64(seats), e.level, queue)
+}
+
+func (e *queueSetEvents) Dequeued(q fairqueuing.FairQueue, r fairqueuing.Request) {
+	m, queue := e.m, q.String()
+
+	seats, _ := r.EstimateCost()
+	m.add(m.waitingRequests, -1, e.level)
+	m.add(m.waitingSeats, -float64(seats), e.level)
+	m.add(m.queueWaitingRequests, -1, e.level, queue)
+	m.add(m.queueWaitingSeats, -float64(seats), e.level, queue)
+
+	m.add(m.executingRequests, 1, e.level)
+	m.add(m.executingSeats, float64(seats), e.level)
+	m.add(m.queueExecutingRequests, 1, e.level, queue)
+	m.add(m.queueExecutingSeats, float64(seats), e.level, queue)
+	m.add(m.dispatched, 1, e.level)
+}
+
+func (e *queueSetEvents) DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType) {}
+
+func (e *queueSetEvents) LimitChanged(limit uint32) {
+	e.m.set(e.m.adaptiveLimit, float64(limit), e.level)
+}
+
+func (e *queueSetEvents) Disposed(r fairqueuing.Request) {
+	m, queue := e.m, e.m.getQueue(r, true)
+
+	seats, _ := r.EstimateCost()
+	m.add(m.executingRequests, -1, e.level)
+	m.add(m.executingSeats, -float64(seats), e.level)
+	m.add(m.queueExecutingRequests, -1, e.level, queue)
+	m.add(m.queueExecutingSeats, -float64(seats), e.level, queue)
+
+	trackers := r.LatencyTrackers()
+	m.observe(m.queueWait, seconds(trackers.QueueWait), e.level, "true")
+	m.observe(m.postDecisionExecutionWait, seconds(trackers.PostDecisionExecutionWait), e.level)
+	m.observe(m.execution, seconds(trackers.ExecutionDuration), e.level)
+	m.observe(m.total, seconds(trackers.TotalDuration), e.level, "true")
+}
+
+func (e *queueSetEvents) Rejected(r fairqueuing.Request, reason fairqueuing.RejectReason) {
+	m := e.m
+	m.add(m.rejectedRequests, 1, e.level, string(reason))
+	queue, ok := m.lookupQueue(r, true)
+	if !ok {
+		// rejected on arrival, it never waited in a queue
+		return
+	}
+
+	seats, _ := r.EstimateCost()
+	m.add(m.waitingRequests, -1, e.level)
+	m.add(m.waitingSeats, -float64(seats), e.level)
+	m.add(m.queueWaitingRequests, -1, e.level, queue)
+	m.add(m.queueWaitingSeats, -float64(seats), e.level, queue)
+
+	trackers := r.LatencyTrackers()
+	m.observe(m.queueWait, seconds(trackers.QueueWait), e.level, "false")
+	m.observe(m.total, seconds(trackers.TotalDuration), e.level, "false")
+}
+
+func seconds(tracker fairqueuing.LatencyTracker) float64 {
+	_, duration := tracker.Get()
+	return duration.Seconds()
+}
+
+var _ apfhttp.Events = &httpEvents{}
+
+type httpEvents struct {
+	m        *Metrics
+	delegate apfhttp.Events
+}
+
+func (e *httpEvents) Arrived(r *http.Request) {
+	e.m.add(e.m.arrived, 1)
+	e.delegate.Arrived(r)
+}
+
+func (e *httpEvents) OnServed(w http.ResponseWriter, r *http.Request) {
+	e.m.add(e.m.served, 1)
+	e.delegate.OnServed(w, r)
+}
+
+func (e *httpEvents) OnRejected(w http.ResponseWriter, r *http.Request, reason fairqueuing.RejectReason) {
+	e.m.add(e.m.rejected, 1, string(reason))
+	e.delegate.OnRejected(w, r, reason)
+}
+
+func (e *httpEvents) OnExempt(w http.ResponseWriter, r *http.Request) {
+	e.m.add(e.m.exempt, 1)
+	e.delegate.OnExempt(w, r)
+}
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/prioritylevel"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	r := &registry{}
+	counter := r.counter("test_total", "A counter.", "code")
+	histogram := r.histogram("test_seconds", "A histogram.", []float64{0.1, 1}, "path")
+
+	r.add(counter, 1, "200")
+	r.add(counter, 2, "429")
+	r.add(counter, 1, "200")
+	r.observe(histogram, 0.05, `/a"b`)
+	r.observe(histogram, 0.5, `/a"b`)
+	r.observe(histogram, 5, `/a"b`)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("expected no error, but got: %v", err)
+	}
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{code="200"} 2
+test_total{code="429"} 2
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{path="/a\"b",le="0.1"} 1
+test_seconds_bucket{path="/a\"b",le="1"} 2
+test_seconds_bucket{path="/a\"b",le="+Inf"} 3
+test_seconds_sum{path="/a\"b"} 5.55
+test_seconds_count{path="/a\"b"} 3
+`
+	if got := buf.String(); want != got {
+		t.Errorf("expected:\n%s\nbut got:\n%s", want, got)
+	}
+}
+
+func TestQueueSetMetrics(t *testing.T) {
+	m := New()
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	qs, err := queueset.NewQueueSet(&queueset.Config{
+		Name:       "catch-all",
+		TotalSeats: 1,
+		QueuingConfig: &queueset.QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+		Clock:         fakeClock,
+		Events:        m.QueueSetEvents("catch-all"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+
+	converter := apfhttp.NewConverter(fakeClock, nil, func(*http.Request) (fairqueuing.FlowIDType, error) {
+		return 0, nil
+	}, func(*http.Request) (uint32, time.Duration, error) {
+		return 1, time.Second, nil
+	})
+	var finishers []fairqueuing.Finisher
+	for i := 0; i < 3; i++ {
+		r, _ := converter.Convert(httptest.NewRequest(http.MethodGet, "/", nil))
+		finisher, err := qs.EnqueueAndDispatch(r)
+		if err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+		finishers = append(finishers, finisher)
+	}
+
+	expect(t, m, []string{
+		`apf_current_executing_requests{priority_level="catch-all"} 1`,
+		`apf_current_waiting_requests{priority_level="catch-all"} 2`,
+		`apf_queue_waiting_seats{priority_level="catch-all",queue="1"} 2`,
+		`apf_dispatched_requests_total{priority_level="catch-all"} 1`,
+	})
+
+	finishers[0].Finish(func() { fakeClock.Step(2 * time.Second) })
+	expect(t, m, []string{
+		`apf_current_executing_requests{priority_level="catch-all"} 1`,
+		`apf_current_waiting_requests{priority_level="catch-all"} 1`,
+		`apf_dispatched_requests_total{priority_level="catch-all"} 2`,
+		`apf_request_execution_seconds_bucket{priority_level="catch-all",le="1"} 0`,
+		`apf_request_execution_seconds_bucket{priority_level="catch-all",le="2.5"} 1`,
+		`apf_request_execution_seconds_count{priority_level="catch-all"} 1`,
+		`apf_request_total_duration_seconds_count{priority_level="catch-all",execute="true"} 1`,
+	})
+}
+
+func TestHTTPEvents(t *testing.T) {
+	m := New()
+	levels, err := prioritylevel.NewController(prioritylevel.Config{Name: "exempt", Exempt: true})
+	if err != nil {
+		t.Fatalf("failed to create priority levels: %v", err)
+	}
+	handler := apfhttp.NewAPFHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), nil, &apfhttp.Config{
+		Exempt:       apfhttp.NewNoExemption(),
+		ErrorHandler: apfhttp.NewDefaultErrorHandler(),
+		Events:       m.HTTPEvents(apfhttp.NewDefaultEvents()),
+		Converter: apfhttp.NewConverter(clocktesting.NewFakeClock(time.Now()), func(r *http.Request) (context.Context, context.CancelFunc) {
+			return context.WithCancel(r.Context())
+		}, func(*http.Request) (fairqueuing.FlowIDType, error) {
+			return 0, nil
+		}, func(*http.Request) (uint32, time.Duration, error) {
+			return 1, time.Second, nil
+		}),
+		Classifier:     apfhttp.ClassifierFunc(func(*http.Request) (string, error) { return "exempt", nil }),
+		PriorityLevels: levels,
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	expect(t, m, []string{
+		`apf_http_arrived_requests_total 1`,
+		`apf_http_served_requests_total 1`,
+	})
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("expected text/plain content, but got: %q", got)
+	}
+}
+
+func expect(t *testing.T, m *Metrics, lines []string) {
+	t.Helper()
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	got := "\n" + buf.String()
+	for _, line := range lines {
+		if !strings.Contains(got, "\n"+line+"\n") {
+			t.Errorf("expected the line %q in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestAdaptiveLimitMetric(t *testing.T) {
+	m := New()
+	limiter, err := queueset.NewAIMDLimiter(queueset.AIMDConfig{
+		LimiterBounds:    queueset.LimiterBounds{Min: 1, Max: 4, Initial: 3},
+		LatencyThreshold: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+	config := &queueset.Config{
+		Name:       "catch-all",
+		TotalSeats: 4,
+		QueuingConfig: &queueset.QueuingConfig{
+			NQueues:        1,
+			QueueMaxLength: 128,
+		},
+		QueueSelector: queueselector.NewRoundRobinQueueSelector(),
+		Clock:         clocktesting.NewFakeClock(time.Now()),
+		Events:        m.QueueSetEvents("catch-all"),
+		Limiter:       limiter,
+	}
+	qs, err := queueset.NewQueueSet(config)
+	if err != nil {
+		t.Fatalf("failed to create queueset: %v", err)
+	}
+	expect(t, m, []string{`apf_current_adaptive_limit_seats{priority_level="catch-all"} 3`})
+
+	config.Limiter = nil
+	if err := qs.Reconfigure(config); err != nil {
+		t.Fatalf("failed to reconfigure queueset: %v", err)
+	}
+	expect(t, m, []string{`apf_current_adaptive_limit_seats{priority_level="catch-all"} 0`})
+}
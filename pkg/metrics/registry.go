@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds, they are
+// the same as the default buckets of the prometheus client.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// registry holds a set of metrics, and writes them in the prometheus
+// text exposition format. It is safe for concurrent use.
+type registry struct {
+	lock    sync.Mutex
+	metrics []*metricVec
+}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// metricVec is a metric partitioned by the values of its labels
+type metricVec struct {
+	name, help string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	// series is keyed by the label values joined with "\xff"
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// value of a counter or a gauge, the sum of a histogram
+	value float64
+	// count, and the cumulative bucket counts of a histogram
+	count   uint64
+	buckets []uint64
+}
+
+func (r *registry) newVec(typ metricType, name, help string, buckets []float64, labelNames ...string) *metricVec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	vec := &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	r.metrics = append(r.metrics, vec)
+	return vec
+}
+
+func (r *registry) counter(name, help string, labelNames ...string) *metricVec {
+	return r.newVec(counterType, name, help, nil, labelNames...)
+}
+
+func (r *registry) gauge(name, help string, labelNames ...string) *metricVec {
+	return r.newVec(gaugeType, name, help, nil, labelNames...)
+}
+
+func (r *registry) histogram(name, help string, buckets []float64, labelNames ...string) *metricVec {
+	return r.newVec(histogramType, name, help, buckets, labelNames...)
+}
+
+// add adds delta to the counter or the gauge with the given label values
+func (r *registry) add(vec *metricVec, delta float64, labelValues ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	vec.get(labelValues).value += delta
+}
+
+// set sets the gauge with the given label values to value
+func (r *registry) set(vec *metricVec, value float64, labelValues ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	vec.get(labelValues).value = value
+}
+
+// observe records the given value in the histogram with the given
+// label values.
+func (r *registry) observe(vec *metricVec, value float64, labelValues ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := vec.get(labelValues)
+	s.value += value
+	s.count++
+	for i, upper := range vec.buckets {
+		if value <= upper {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (vec *metricVec) get(labelValues []string) *series {
+	if len(labelValues) != len(vec.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, but got %d", vec.name, len(vec.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := vec.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if vec.typ == histogramType {
+			s.buckets = make([]uint64, len(vec.buckets))
+		}
+		vec.series[key] = s
+	}
+	return s
+}
+
+// WriteTo writes all metrics in the text exposition format, the series
+// of a metric are sorted by their label values.
+func (r *registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, vec := range r.metrics {
+		fmt.Fprintf(cw, "# HELP %s %s\n", vec.name, escape(vec.help, false))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", vec.name, vec.typ)
+
+		keys := make([]string, 0, len(vec.series))
+		for key := range vec.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := vec.series[key]
+			if vec.typ != histogramType {
+				fmt.Fprintf(cw, "%s%s %s\n", vec.name, labels(vec.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+				continue
+			}
+			for i, upper := range vec.buckets {
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", vec.name, labels(vec.labelNames, s.labelValues, "le", formatFloat(upper)), s.buckets[i])
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", vec.name, labels(vec.labelNames, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", vec.name, labels(vec.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+			fmt.Fprintf(cw, "%s_count%s %d\n", vec.name, labels(vec.labelNames, s.labelValues, "", ""), s.count)
+		}
+	}
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics in the text exposition format
+func (r *registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func labels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", names[i], escape(values[i], true)))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,96 @@
+package simulator
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// epoch is the simulated time at which a simulation starts
+var epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{clock: clocktesting.NewFakeClock(epoch)}
+}
+
+// eventLoop fires the events in the order of their simulated time,
+// and sets the fake clock to the time of each event before it fires.
+// Events may be scheduled from any goroutine.
+type eventLoop struct {
+	clock *clocktesting.FakeClock
+
+	lock   sync.Mutex
+	events eventQueue
+	seq    uint64
+}
+
+func (l *eventLoop) schedule(at time.Time, fire func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.seq++
+	heap.Push(&l.events, &event{at: at, seq: l.seq, fire: fire})
+}
+
+// next removes the earliest event, and advances the clock to it
+func (l *eventLoop) next() (*event, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.events.Len() == 0 {
+		return nil, false
+	}
+	e := heap.Pop(&l.events).(*event)
+	l.clock.SetTime(e.at)
+	return e, true
+}
+
+// run fires the events until there are none left, after is invoked
+// after each event, and stops the loop if it returns an error.
+func (l *eventLoop) run(after func() error) error {
+	for {
+		e, ok := l.next()
+		if !ok {
+			return nil
+		}
+		e.fire()
+		if err := after(); err != nil {
+			return err
+		}
+	}
+}
+
+// event happens at the given simulated time, the events that happen
+// at the same time are fired in the order they were scheduled.
+type event struct {
+	at   time.Time
+	seq  uint64
+	fire func()
+}
+
+// eventQueue implements heap.Interface
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
@@ -0,0 +1,361 @@
+package simulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+
+	"k8s.io/utils/clock"
+)
+
+// ReplayQueueSet pushes the requests of the trace through a queueset
+// with the given settings, under a fake clock, and returns what
+// happened to each of them.
+func ReplayQueueSet(spec *QueueSet, trace []Record) ([]Result, error) {
+	if err := validateReplay(spec, trace); err != nil {
+		return nil, err
+	}
+
+	loop := newEventLoop()
+	recorder := newRecorder(loop.clock, trace)
+	qs, err := newQueueSet(spec, loop.clock, recorder)
+	if err != nil {
+		return nil, err
+	}
+
+	var replayErr error
+	for i := range trace {
+		i, record := i, &trace[i]
+		loop.schedule(epoch.Add(record.Arrival.Duration), func() {
+			r := newRequest(loop.clock, record.ID, record.flowID(), record.Seats, record.estimate(), record.Duration.Duration)
+			r.onExecute = func(r *request) {
+				loop.schedule(loop.clock.Now().Add(r.execution), r.finish)
+			}
+			recorder.track(i, r)
+
+			finisher, err := qs.EnqueueAndDispatch(r)
+			if err != nil {
+				var rejected *fairqueuing.RejectedError
+				if !errors.As(err, &rejected) {
+					replayErr = fmt.Errorf("failed to enqueue request %q: %w", record.ID, err)
+				}
+				return
+			}
+			r.finisher = finisher
+
+			if timeout := queueWaitTimeout(spec, record); timeout > 0 {
+				loop.schedule(loop.clock.Now().Add(timeout), func() { r.timeout() })
+			}
+		})
+	}
+	if err := loop.run(func() error { return replayErr }); err != nil {
+		return nil, err
+	}
+	return recorder.results(), nil
+}
+
+// ReplayHandler pushes the requests of the trace through the full
+// stack of the http handler, each request is served by a goroutine of
+// its own, as a server would. The fake clock is only advanced once
+// every goroutine is either waiting for a decision, or executing a
+// request whose time has not come to finish yet.
+func ReplayHandler(spec *QueueSet, trace []Record) ([]Result, error) {
+	if err := validateReplay(spec, trace); err != nil {
+		return nil, err
+	}
+
+	loop := newEventLoop()
+	recorder := newRecorder(loop.clock, trace)
+	qs, err := newQueueSet(spec, loop.clock, recorder)
+	if err != nil {
+		return nil, err
+	}
+	gate := newGate()
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		record := &trace[recordIndex(req)]
+		release := make(chan struct{})
+		loop.schedule(loop.clock.Now().Add(record.Duration.Duration), func() {
+			gate.add(1)
+			close(release)
+		})
+
+		gate.add(-1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	converter := apfhttp.NewConverter(loop.clock, nil,
+		func(req *http.Request) (fairqueuing.FlowIDType, error) {
+			return trace[recordIndex(req)].flowID(), nil
+		},
+		func(req *http.Request) (uint32, time.Duration, error) {
+			record := &trace[recordIndex(req)]
+			return record.Seats, record.estimate(), nil
+		},
+	)
+	handler := apfhttp.NewAPFHandler(inner, qs, &apfhttp.Config{
+		Exempt:       apfhttp.NewNoExemption(),
+		ErrorHandler: apfhttp.NewDefaultErrorHandler(),
+		Events:       apfhttp.NewDefaultEvents(),
+		Clock:        loop.clock,
+		Converter:    &gatingConverter{Converter: converter, gate: gate, recorder: recorder},
+	})
+
+	for i := range trace {
+		i, record := i, &trace[i]
+		loop.schedule(epoch.Add(record.Arrival.Duration), func() {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), recordIndexKey{}, i))
+			w := httptest.NewRecorder()
+
+			gate.add(1)
+			go func() {
+				defer gate.add(-1)
+				handler.ServeHTTP(w, req)
+				recorder.respond(i, w.Code)
+			}()
+
+			if timeout := queueWaitTimeout(spec, record); timeout > 0 {
+				loop.schedule(loop.clock.Now().Add(timeout), func() {
+					if r, ok := recorder.request(i); ok {
+						r.Reject(fairqueuing.RejectTimedOutInQueue)
+					}
+				})
+			}
+		})
+	}
+	if err := loop.run(gate.settle); err != nil {
+		return nil, err
+	}
+	return recorder.results(), nil
+}
+
+func validateReplay(spec *QueueSet, trace []Record) error {
+	if err := spec.validate("queueSet"); err != nil {
+		return err
+	}
+	return validateTrace(spec, trace)
+}
+
+func queueWaitTimeout(spec *QueueSet, record *Record) time.Duration {
+	if record.Timeout.Duration > 0 {
+		return record.Timeout.Duration
+	}
+	return spec.QueueWaitTimeout.Duration
+}
+
+type recordIndexKey struct{}
+
+func recordIndex(req *http.Request) int {
+	return req.Context().Value(recordIndexKey{}).(int)
+}
+
+func newGate() *gate {
+	g := &gate{}
+	g.cond = sync.NewCond(&g.lock)
+	return g
+}
+
+// gate counts the goroutines of a replay that have work to do at the
+// current simulated time.
+type gate struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	busy int
+}
+
+func (g *gate) add(delta int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.busy += delta
+	if g.busy == 0 {
+		g.cond.Broadcast()
+	}
+}
+
+// settle blocks until none of the goroutines is busy
+func (g *gate) settle() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for g.busy > 0 {
+		g.cond.Wait()
+	}
+	return nil
+}
+
+// gatingConverter wraps the requests of the converter, so the gate
+// knows when their goroutines block.
+type gatingConverter struct {
+	apfhttp.Converter
+	gate     *gate
+	recorder *recorder
+}
+
+func (c *gatingConverter) Convert(req *http.Request) (fairqueuing.Request, error) {
+	r, err := c.Converter.Convert(req)
+	if err != nil {
+		return nil, err
+	}
+	gated := &gatedRequest{Request: r, gate: c.gate}
+	c.recorder.track(recordIndex(req), gated)
+	return gated, nil
+}
+
+// gatedRequest tells the gate when the goroutine serving the request
+// blocks waiting for a decision, and when the decision wakes it up.
+type gatedRequest struct {
+	fairqueuing.Request
+	gate *gate
+
+	lock             sync.Mutex
+	decided, waiting bool
+}
+
+func (r *gatedRequest) WaitForDecision() fairqueuing.DecisionType {
+	r.lock.Lock()
+	if !r.decided {
+		r.waiting = true
+		r.gate.add(-1)
+	}
+	r.lock.Unlock()
+
+	return r.Request.WaitForDecision()
+}
+
+func (r *gatedRequest) SetDecision(d fairqueuing.DecisionType) bool {
+	return r.decide(func() bool { return r.Request.SetDecision(d) })
+}
+
+func (r *gatedRequest) Reject(reason fairqueuing.RejectReason) bool {
+	return r.decide(func() bool { return r.Request.Reject(reason) })
+}
+
+func (r *gatedRequest) decide(set func() bool) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !set() {
+		return false
+	}
+	r.decided = true
+	if r.waiting {
+		// the waiter is busy again, it is accounted for before the
+		// event that woke it up is done firing.
+		r.waiting = false
+		r.gate.add(1)
+	}
+	return true
+}
+
+func newRecorder(clock clock.PassiveClock, trace []Record) *recorder {
+	rec := &recorder{
+		clock:    clock,
+		indices:  map[fairqueuing.Request]int{},
+		requests: make([]fairqueuing.Request, len(trace)),
+		entries:  make([]Result, len(trace)),
+		decided:  make([]time.Time, len(trace)),
+	}
+	for i := range trace {
+		rec.entries[i].ID = trace[i].ID
+		rec.entries[i].Arrival = trace[i].Arrival
+	}
+	return rec
+}
+
+// recorder implements queueset.Events, it records what the queueset
+// did with each request of the trace.
+type recorder struct {
+	clock clock.PassiveClock
+
+	lock     sync.Mutex
+	indices  map[fairqueuing.Request]int
+	requests []fairqueuing.Request
+	entries  []Result
+	decided  []time.Time
+}
+
+func (rec *recorder) track(i int, r fairqueuing.Request) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	rec.indices[r] = i
+	rec.requests[i] = r
+}
+
+func (rec *recorder) request(i int) (fairqueuing.Request, bool) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	return rec.requests[i], rec.requests[i] != nil
+}
+
+func (rec *recorder) respond(i, code int) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	rec.entries[i].Code = code
+}
+
+func (rec *recorder) update(r fairqueuing.Request, fn func(*Result, int)) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if i, ok := rec.indices[r]; ok {
+		fn(&rec.entries[i], i)
+	}
+}
+
+func (rec *recorder) QueueSelected(q fairqueuing.FairQueue, r fairqueuing.Request) {
+	rec.update(r, func(result *Result, _ int) {
+		id := q.ID()
+		result.Queue = &id
+	})
+}
+
+func (rec *recorder) DecisionChanged(r fairqueuing.Request, d fairqueuing.DecisionType) {
+	if d != fairqueuing.DecisionExecute {
+		return
+	}
+	rec.update(r, func(result *Result, i int) {
+		result.Decision = DecisionExecute
+		rec.decided[i] = rec.clock.Now()
+	})
+}
+
+func (rec *recorder) Rejected(r fairqueuing.Request, reason fairqueuing.RejectReason) {
+	rec.update(r, func(result *Result, i int) {
+		result.Decision, result.Reason = DecisionReject, reason
+		rec.decided[i] = rec.clock.Now()
+	})
+}
+
+func (rec *recorder) Enqueued(fairqueuing.FairQueue, fairqueuing.Request) {}
+func (rec *recorder) Dequeued(fairqueuing.FairQueue, fairqueuing.Request) {}
+func (rec *recorder) Disposed(fairqueuing.Request)                        {}
+
+func (rec *recorder) results() []Result {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	results := make([]Result, len(rec.entries))
+	for i, result := range rec.entries {
+		if !rec.decided[i].IsZero() {
+			result.Wait.Duration = rec.decided[i].Sub(epoch.Add(result.Arrival.Duration))
+		}
+		if r := rec.requests[i]; r != nil {
+			result.StartR, result.FinishR = r.StartR().ToFloat(), r.FinishR().ToFloat()
+		}
+		results[i] = result
+	}
+	return results
+}
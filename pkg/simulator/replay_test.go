@@ -0,0 +1,114 @@
+package simulator
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/config"
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+const trace = `
+{"id":"a","arrival":"0s","flow":["x"],"seats":1,"duration":"2s"}
+{"id":"b","arrival":"0s","flow":["x"],"seats":1,"duration":"2s"}
+{"id":"c","arrival":"0s","flow":["y"],"seats":1,"duration":"1s"}
+{"id":"d","arrival":"0s","flow":["y"],"seats":1,"duration":"1s"}
+
+{"arrival":"1500ms","flow":["z"],"seats":1,"duration":"1s","timeout":"5s"}
+`
+
+func TestReplay(t *testing.T) {
+	records, err := ReadTrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	if id := records[4].ID; id != "7" {
+		t.Errorf("expected the ID to default to the line number, but got: %q", id)
+	}
+
+	spec := &QueueSet{
+		TotalSeats:       2,
+		Queues:           1,
+		HandSize:         1,
+		QueueLengthLimit: 1,
+		QueueWaitTimeout: config.Duration{Duration: time.Second},
+	}
+	type want struct {
+		decision string
+		reason   fairqueuing.RejectReason
+		wait     time.Duration
+		code     int
+	}
+	wants := []want{
+		{decision: DecisionExecute, code: http.StatusOK},
+		{decision: DecisionExecute, code: http.StatusOK},
+		{decision: DecisionReject, reason: fairqueuing.RejectTimedOutInQueue, wait: time.Second, code: http.StatusTooManyRequests},
+		{decision: DecisionReject, reason: fairqueuing.RejectQueueFull, code: http.StatusTooManyRequests},
+		{decision: DecisionExecute, wait: 500 * time.Millisecond, code: http.StatusOK},
+	}
+
+	replays := map[string]func(*QueueSet, []Record) ([]Result, error){
+		"queueset": ReplayQueueSet,
+		"handler":  ReplayHandler,
+	}
+	var got [][]Result
+	for name, replay := range replays {
+		t.Run(name, func(t *testing.T) {
+			results, err := replay(spec, records)
+			if err != nil {
+				t.Fatalf("failed to replay: %v", err)
+			}
+			if len(results) != len(wants) {
+				t.Fatalf("expected %d results, but got: %d", len(wants), len(results))
+			}
+			for i, want := range wants {
+				result := results[i]
+				if result.ID != records[i].ID || result.Decision != want.decision || result.Reason != want.reason || result.Wait.Duration != want.wait {
+					t.Errorf("[%s]: expected %+v, but got: %+v", records[i].ID, want, result)
+				}
+				if result.Queue == nil || *result.Queue != 1 {
+					t.Errorf("[%s]: expected the request to be assigned to queue 1, but got: %v", records[i].ID, result.Queue)
+				}
+				if name == "handler" && result.Code != want.code {
+					t.Errorf("[%s]: expected status code %d, but got: %d", records[i].ID, want.code, result.Code)
+				}
+				result.Code = 0
+				results[i] = result
+			}
+			got = append(got, results)
+		})
+	}
+
+	if len(got) == 2 && !reflect.DeepEqual(got[0], got[1]) {
+		t.Errorf("expected the queueset and the handler to agree\n%+v\n%+v", got[0], got[1])
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	queue := uint32(3)
+	results := []Result{
+		{ID: "a", Decision: DecisionExecute, Queue: &queue, Arrival: config.Duration{Duration: time.Second}, StartR: 1, FinishR: 2},
+		{ID: "b", Decision: DecisionReject, Reason: fairqueuing.RejectQueueFull},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteResults(buf, results); err != nil {
+		t.Fatalf("failed to write results: %v", err)
+	}
+	want := `{"id":"a","decision":"execute","queue":3,"arrival":"1s","wait":"0s","startR":1,"finishR":2}
+{"id":"b","decision":"reject","reason":"queue-full","arrival":"0s","wait":"0s","startR":0,"finishR":0}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("expected:\n%s\nbut got:\n%s", want, got)
+	}
+}
+
+func TestReadTraceRejectsUnknownFields(t *testing.T) {
+	_, err := ReadTrace(strings.NewReader(`{"arrival":"0s","seats":1}` + "\n" + `{"arrival":"0s","cost":1}`))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error naming line 2, but got: %v", err)
+	}
+}
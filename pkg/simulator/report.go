@@ -0,0 +1,142 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/fairness"
+)
+
+// Report tells how each flow of a scenario fared
+type Report struct {
+	Seed int64 `json:"seed"`
+
+	// Duration is the simulated time during which the requests
+	// arrived, the rates are relative to it.
+	Duration time.Duration `json:"duration"`
+
+	Flows []FlowReport `json:"flows"`
+
+	// Fairness is the Jain's fairness index of the seat-seconds
+	// served to the flows, each relative to the max-min fair share of
+	// the flow; it is 1 if every flow got its fair share.
+	Fairness float64 `json:"fairness"`
+}
+
+// FlowReport tells how the requests of a flow fared
+type FlowReport struct {
+	Name     string                           `json:"name"`
+	Arrived  int                              `json:"arrived"`
+	Executed int                              `json:"executed"`
+	Rejected map[fairqueuing.RejectReason]int `json:"rejected,omitempty"`
+
+	// Throughput is the number of requests executed per second
+	Throughput float64 `json:"throughput"`
+
+	// RejectionRate is the fraction of the requests that arrived,
+	// and were rejected.
+	RejectionRate float64 `json:"rejectionRate"`
+
+	// QueueWait is the distribution of the time the executed
+	// requests waited in queue.
+	QueueWait Percentiles `json:"queueWait"`
+
+	// Demand is the seat-seconds of the requests that arrived, and
+	// Served of the requests that executed, FairShare is the max-min
+	// fair share of the seat-seconds of the queueset.
+	Demand    float64 `json:"demand"`
+	Served    float64 `json:"served"`
+	FairShare float64 `json:"fairShare"`
+}
+
+type Percentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+func (sim *simulation) report() *Report {
+	duration := sim.scenario.Duration.Duration
+	report := &Report{Seed: sim.scenario.Seed, Duration: duration}
+
+	demands, served := make([]float64, len(sim.flows)), make([]float64, len(sim.flows))
+	for i, flow := range sim.flows {
+		demands[i], served[i] = flow.demand, flow.served
+	}
+	capacity := float64(sim.scenario.QueueSet.TotalSeats) * duration.Seconds()
+	shares := fairness.MaxMinFairShares(demands, capacity)
+
+	for i, flow := range sim.flows {
+		fr := FlowReport{
+			Name:       flow.spec.Name,
+			Arrived:    flow.arrived,
+			Executed:   flow.executed,
+			Throughput: float64(flow.executed) / duration.Seconds(),
+			QueueWait:  percentiles(flow.queueWaits),
+			Demand:     flow.demand,
+			Served:     flow.served,
+			FairShare:  shares[i],
+		}
+		rejected := 0
+		for reason, count := range flow.rejected {
+			if fr.Rejected == nil {
+				fr.Rejected = map[fairqueuing.RejectReason]int{}
+			}
+			fr.Rejected[reason] = count
+			rejected += count
+		}
+		if flow.arrived > 0 {
+			fr.RejectionRate = float64(rejected) / float64(flow.arrived)
+		}
+		report.Flows = append(report.Flows, fr)
+	}
+	report.Fairness = fairness.Fairness(served, shares)
+	return report
+}
+
+func percentiles(durations []time.Duration) Percentiles {
+	if len(durations) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p float64) time.Duration {
+		// nearest rank
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return Percentiles{P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: sorted[len(sorted)-1]}
+}
+
+// WriteText writes the report as a table
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "seed: %d, duration: %s, fairness: %.3f\n\n", r.Seed, r.Duration, r.Fairness)
+	fmt.Fprintln(tw, "FLOW\tARRIVED\tEXECUTED\tREQ/S\tREJECTED\tWAIT P50\tP90\tP99\tMAX\tSERVED\tFAIR SHARE\tREJECTIONS")
+	for _, f := range r.Flows {
+		reasons := make([]string, 0, len(f.Rejected))
+		for reason, count := range f.Rejected {
+			reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+		}
+		sort.Strings(reasons)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%.1f%%\t%s\t%s\t%s\t%s\t%.1f\t%.1f\t%s\n",
+			f.Name, f.Arrived, f.Executed, f.Throughput, 100*f.RejectionRate,
+			round(f.QueueWait.P50), round(f.QueueWait.P90), round(f.QueueWait.P99), round(f.QueueWait.Max),
+			f.Served, f.FairShare, strings.Join(reasons, ","))
+	}
+	return tw.Flush()
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
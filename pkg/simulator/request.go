@@ -0,0 +1,98 @@
+package simulator
+
+import (
+	"context"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+	"k8s.io/utils/clock"
+)
+
+// request is a simulated request, its decision is made synchronously:
+// the simulation only finishes a request once a decision has been
+// made for it, so WaitForDecision never blocks.
+type request struct {
+	virtual.RTracker
+
+	name     string
+	flowID   fairqueuing.FlowIDType
+	seats    uint32
+	estimate time.Duration
+	// execution is the time the request actually takes to execute
+	execution time.Duration
+	trackers  fairqueuing.LatencyTrackers
+
+	decision fairqueuing.DecisionType
+	reason   fairqueuing.RejectReason
+	// onExecute is invoked, with the queueset lock held, as soon as
+	// the request is dispatched.
+	onExecute func(*request)
+	finisher  fairqueuing.Finisher
+}
+
+var _ fairqueuing.Request = &request{}
+
+func (r *request) GetFlowID() fairqueuing.FlowIDType { return r.flowID }
+func (r *request) EstimateCost() (seats uint32, width virtual.SeatSeconds) {
+	return r.seats, virtual.SeatsTimesDuration(float64(r.seats), r.estimate)
+}
+func (r *request) Context() context.Context                     { return context.Background() }
+func (r *request) CancelFunc() context.CancelFunc               { return nil }
+func (r *request) String() string                               { return r.name }
+func (r *request) LatencyTrackers() fairqueuing.LatencyTrackers { return r.trackers }
+
+func (r *request) WaitForDecision() fairqueuing.DecisionType { return r.decision }
+func (r *request) RejectReason() fairqueuing.RejectReason    { return r.reason }
+
+func (r *request) SetDecision(d fairqueuing.DecisionType) bool {
+	if r.decision != fairqueuing.DecisionNone {
+		return false
+	}
+	r.decision = d
+	if d == fairqueuing.DecisionExecute {
+		r.onExecute(r)
+	}
+	return true
+}
+
+func (r *request) Reject(reason fairqueuing.RejectReason) bool {
+	if r.decision != fairqueuing.DecisionNone {
+		return false
+	}
+	r.decision, r.reason = fairqueuing.DecisionReject, reason
+	return true
+}
+
+// timeout rejects the request if it is still waiting in its queue, it
+// returns false if the request has been dispatched already.
+func (r *request) timeout() bool {
+	if !r.Reject(fairqueuing.RejectTimedOutInQueue) {
+		return false
+	}
+	r.finisher.Finish(func() {})
+	return true
+}
+
+// executionTracker reports the simulated execution time of a request,
+// the finisher starts and finishes it back to back once the simulated
+// time has advanced past the execution.
+type executionTracker struct {
+	clock     clock.PassiveClock
+	execution time.Duration
+	startedAt time.Time
+}
+
+func (t *executionTracker) Start()  { t.startedAt = t.clock.Now().Add(-t.execution) }
+func (t *executionTracker) Finish() {}
+func (t *executionTracker) Get() (time.Time, time.Duration) {
+	return t.startedAt, t.execution
+}
+
+// finish completes the execution of a dispatched request
+func (r *request) finish() {
+	r.finisher.Finish(func() {
+		// the simulated time does not advance while the handler
+		// executes, it already has.
+	})
+}
@@ -0,0 +1,203 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/tkashem/apf/pkg/config"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Scenario describes a queueset, and the synthetic workload it is
+// subjected to, it can be written in YAML or JSON.
+type Scenario struct {
+	// Seed of the random number generators, a scenario that is run
+	// with the same seed always produces the same report.
+	Seed int64 `json:"seed,omitempty"`
+
+	// Duration is the simulated time during which the requests
+	// arrive, the simulation goes on until the last one is done.
+	Duration config.Duration `json:"duration"`
+
+	QueueSet QueueSet `json:"queueSet"`
+	Flows    []Flow   `json:"flows"`
+}
+
+// QueueSet holds the settings of the queueset under simulation
+type QueueSet struct {
+	TotalSeats       uint32 `json:"totalSeats"`
+	Queues           int    `json:"queues"`
+	HandSize         int    `json:"handSize"`
+	QueueLengthLimit int    `json:"queueLengthLimit"`
+
+	// QueueWaitTimeout, if positive, is the maximum time a request
+	// may wait in queue before it is rejected.
+	QueueWaitTimeout config.Duration `json:"queueWaitTimeout,omitempty"`
+}
+
+// Flow describes the requests of a flow, they arrive as a Poisson
+// process with the given rate.
+type Flow struct {
+	Name string `json:"name"`
+
+	// Rate is the mean number of requests that arrive per second
+	Rate float64 `json:"rate"`
+
+	// Seats is the number of seats each request occupies
+	Seats uint32 `json:"seats"`
+
+	// Execution is the distribution of the execution time
+	Execution Distribution `json:"execution"`
+
+	// Estimate is the execution time the queueset is told each
+	// request takes, it defaults to the mean of Execution.
+	Estimate config.Duration `json:"estimate,omitempty"`
+}
+
+type DistributionType string
+
+const (
+	// DistributionConstant always yields Mean
+	DistributionConstant DistributionType = "Constant"
+
+	// DistributionExponential yields exponentially distributed
+	// values with the given Mean
+	DistributionExponential DistributionType = "Exponential"
+
+	// DistributionUniform yields values uniformly distributed in
+	// the range [Min, Max]
+	DistributionUniform DistributionType = "Uniform"
+)
+
+// Distribution of a duration
+type Distribution struct {
+	Type DistributionType `json:"type"`
+	Mean config.Duration  `json:"mean,omitempty"`
+	Min  config.Duration  `json:"min,omitempty"`
+	Max  config.Duration  `json:"max,omitempty"`
+}
+
+func (d *Distribution) sample(rnd *rand.Rand) time.Duration {
+	switch d.Type {
+	case DistributionExponential:
+		return time.Duration(rnd.ExpFloat64() * float64(d.Mean.Duration))
+	case DistributionUniform:
+		return d.Min.Duration + time.Duration(rnd.Int63n(int64(d.Max.Duration-d.Min.Duration)+1))
+	}
+	return d.Mean.Duration
+}
+
+func (d *Distribution) mean() time.Duration {
+	if d.Type == DistributionUniform {
+		return (d.Min.Duration + d.Max.Duration) / 2
+	}
+	return d.Mean.Duration
+}
+
+// ParseScenario decodes the given YAML or JSON scenario, and validates
+// it. Unknown fields are rejected.
+func ParseScenario(data []byte) (*Scenario, error) {
+	s := &Scenario{}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario: %w", err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadScenario reads and parses the scenario in the given file
+func ReadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Validate returns an error for each field of the scenario that is
+// invalid, the error names the offending field. A scenario without
+// flows only describes a queueset, a trace can be replayed through it.
+func (s *Scenario) Validate() error {
+	var errs []error
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	if len(s.Flows) > 0 && s.Duration.Duration <= 0 {
+		add("duration", "must be positive")
+	}
+	qs := s.QueueSet
+	if err := qs.validate("queueSet"); err != nil {
+		errs = append(errs, err)
+	}
+
+	names := map[string]bool{}
+	for i, flow := range s.Flows {
+		path := fmt.Sprintf("flows[%d]", i)
+		switch {
+		case len(flow.Name) == 0:
+			add(path+".name", "must not be empty")
+		case names[flow.Name]:
+			add(path+".name", "%q is specified more than once", flow.Name)
+		}
+		names[flow.Name] = true
+
+		if flow.Rate <= 0 || math.IsInf(flow.Rate, 0) || math.IsNaN(flow.Rate) {
+			add(path+".rate", "must be positive")
+		}
+		if flow.Seats < 1 || flow.Seats > qs.TotalSeats {
+			add(path+".seats", "must be in the range [1, %d]", qs.TotalSeats)
+		}
+		if flow.Estimate.Duration < 0 {
+			add(path+".estimate", "must not be negative")
+		}
+
+		d := flow.Execution
+		switch d.Type {
+		case DistributionConstant, DistributionExponential:
+			if d.Mean.Duration <= 0 {
+				add(path+".execution.mean", "must be positive")
+			}
+		case DistributionUniform:
+			if d.Min.Duration <= 0 || d.Max.Duration < d.Min.Duration {
+				add(path+".execution", "must have 0 < min <= max")
+			}
+		default:
+			add(path+".execution.type", "must be one of %q, %q, %q", DistributionConstant, DistributionExponential, DistributionUniform)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (qs *QueueSet) validate(path string) error {
+	var errs []error
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s.%s: %s", path, field, fmt.Sprintf(format, args...)))
+	}
+
+	if qs.TotalSeats < 1 {
+		add("totalSeats", "must be positive")
+	}
+	if qs.QueueLengthLimit < 0 {
+		add("queueLengthLimit", "must not be negative")
+	}
+	if _, err := queueselector.NewDealer(qs.Queues, qs.HandSize); err != nil {
+		add("handSize", "invalid for %d queues: %v", qs.Queues, err)
+	}
+	if qs.QueueWaitTimeout.Duration < 0 {
+		add("queueWaitTimeout", "must not be negative")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,198 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueselector"
+	"github.com/tkashem/apf/pkg/fairqueuing/queueset"
+	"github.com/tkashem/apf/pkg/fairqueuing/virtual"
+	"github.com/tkashem/apf/pkg/latencytracker"
+
+	"k8s.io/utils/clock"
+)
+
+// Run simulates the given scenario, it drives a real queueset with a
+// fake clock, and reports how each flow fared. The report depends on
+// nothing but the scenario, including its seed.
+func Run(s *Scenario) (*Report, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	if len(s.Flows) == 0 {
+		return nil, fmt.Errorf("flows: the scenario has no flows to simulate")
+	}
+
+	sim, err := newSimulation(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := sim.run(); err != nil {
+		return nil, err
+	}
+	return sim.report(), nil
+}
+
+type simulation struct {
+	*eventLoop
+	scenario *Scenario
+	qs       fairqueuing.FairQueueSet
+	end      time.Time
+
+	flows []*flowState
+	err   error
+}
+
+// flowState holds the random source of a flow, and what happened
+// to its requests so far.
+type flowState struct {
+	spec *Flow
+	id   fairqueuing.FlowIDType
+	rnd  *rand.Rand
+
+	arrived, executed int
+	rejected          map[fairqueuing.RejectReason]int
+	queueWaits        []time.Duration
+	// demand is the seat-seconds of the requests that arrived, and
+	// served of the requests that executed.
+	demand, served float64
+}
+
+func newSimulation(s *Scenario) (*simulation, error) {
+	sim := &simulation{
+		eventLoop: newEventLoop(),
+		scenario:  s,
+		end:       epoch.Add(s.Duration.Duration),
+	}
+
+	qs, err := newQueueSet(&s.QueueSet, sim.clock, noopEvents{})
+	if err != nil {
+		return nil, err
+	}
+	sim.qs = qs
+
+	for i := range s.Flows {
+		spec := &s.Flows[i]
+		hash := fnv.New64a()
+		hash.Write([]byte(spec.Name))
+		// each flow has its own random source, so a change to one
+		// flow does not change the workload of the others.
+		sim.flows = append(sim.flows, &flowState{
+			spec:     spec,
+			id:       fairqueuing.FlowIDType(hash.Sum64()),
+			rnd:      rand.New(rand.NewSource(s.Seed + int64(i))),
+			rejected: map[fairqueuing.RejectReason]int{},
+		})
+	}
+	return sim, nil
+}
+
+func newQueueSet(spec *QueueSet, clock clock.Clock, events queueset.Events) (fairqueuing.FairQueueSet, error) {
+	selector, err := queueselector.NewShuffleShardingQueueSelector(spec.Queues, spec.HandSize)
+	if err != nil {
+		return nil, err
+	}
+	return queueset.NewQueueSet(&queueset.Config{
+		Name:       "simulation",
+		TotalSeats: spec.TotalSeats,
+		QueuingConfig: &queueset.QueuingConfig{
+			NQueues:        spec.Queues,
+			HandSize:       spec.HandSize,
+			QueueMaxLength: spec.QueueLengthLimit,
+		},
+		QueueSelector: selector,
+		Clock:         clock,
+		Events:        events,
+	})
+}
+
+func (sim *simulation) run() error {
+	for _, flow := range sim.flows {
+		sim.scheduleArrival(flow)
+	}
+	return sim.eventLoop.run(func() error { return sim.err })
+}
+
+func (sim *simulation) scheduleArrival(flow *flowState) {
+	interval := time.Duration(flow.rnd.ExpFloat64() / flow.spec.Rate * float64(time.Second))
+	if at := sim.clock.Now().Add(interval); at.Before(sim.end) {
+		sim.schedule(at, func() { sim.arrive(flow) })
+	}
+}
+
+func (sim *simulation) arrive(flow *flowState) {
+	defer sim.scheduleArrival(flow)
+
+	spec := flow.spec
+	estimate := spec.Estimate.Duration
+	if estimate == 0 {
+		estimate = spec.Execution.mean()
+	}
+	r := newRequest(sim.clock, fmt.Sprintf("%s/%d", spec.Name, flow.arrived), flow.id, spec.Seats, estimate, spec.Execution.sample(flow.rnd))
+	r.onExecute = func(r *request) { sim.execute(flow, r) }
+	flow.arrived++
+	flow.demand += float64(r.seats) * r.execution.Seconds()
+
+	finisher, err := sim.qs.EnqueueAndDispatch(r)
+	if err != nil {
+		var rejected *fairqueuing.RejectedError
+		if !errors.As(err, &rejected) {
+			sim.err = fmt.Errorf("failed to enqueue request %s: %w", r, err)
+			return
+		}
+		flow.rejected[rejected.Reason]++
+		return
+	}
+	r.finisher = finisher
+
+	if timeout := sim.scenario.QueueSet.QueueWaitTimeout.Duration; timeout > 0 {
+		sim.schedule(sim.clock.Now().Add(timeout), func() {
+			if r.timeout() {
+				flow.rejected[fairqueuing.RejectTimedOutInQueue]++
+			}
+		})
+	}
+}
+
+// execute is invoked when the queueset dispatches the request, the
+// request is done once its execution time has elapsed.
+func (sim *simulation) execute(flow *flowState, r *request) {
+	sim.schedule(sim.clock.Now().Add(r.execution), func() {
+		r.finish()
+
+		flow.executed++
+		flow.served += float64(r.seats) * r.execution.Seconds()
+		_, wait := r.trackers.QueueWait.Get()
+		flow.queueWaits = append(flow.queueWaits, wait)
+	})
+}
+
+func newRequest(clock clock.PassiveClock, name string, flowID fairqueuing.FlowIDType, seats uint32, estimate, execution time.Duration) *request {
+	return &request{
+		RTracker:  virtual.NewRTracker(),
+		name:      name,
+		flowID:    flowID,
+		seats:     seats,
+		estimate:  estimate,
+		execution: execution,
+		trackers: fairqueuing.LatencyTrackers{
+			QueueWait:                 latencytracker.NewLatencyTracker(clock),
+			PostDecisionExecutionWait: latencytracker.NewLatencyTracker(clock),
+			ExecutionDuration:         &executionTracker{clock: clock, execution: execution},
+			TotalDuration:             latencytracker.NewLatencyTracker(clock),
+		},
+	}
+}
+
+type noopEvents struct{}
+
+func (noopEvents) QueueSelected(fairqueuing.FairQueue, fairqueuing.Request)      {}
+func (noopEvents) Enqueued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (noopEvents) Dequeued(fairqueuing.FairQueue, fairqueuing.Request)           {}
+func (noopEvents) DecisionChanged(fairqueuing.Request, fairqueuing.DecisionType) {}
+func (noopEvents) Disposed(fairqueuing.Request)                                  {}
+func (noopEvents) Rejected(fairqueuing.Request, fairqueuing.RejectReason)        {}
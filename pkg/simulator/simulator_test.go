@@ -0,0 +1,125 @@
+package simulator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkashem/apf/pkg/fairqueuing"
+)
+
+const scenario = `
+seed: 1
+duration: 30s
+queueSet:
+  totalSeats: 10
+  queues: 64
+  handSize: 6
+  queueLengthLimit: 50
+  queueWaitTimeout: 5s
+flows:
+- name: elephant
+  rate: 200
+  seats: 1
+  execution: {type: Exponential, mean: 100ms}
+- name: mouse
+  rate: 10
+  seats: 1
+  execution: {type: Constant, mean: 100ms}
+- name: wide
+  rate: 5
+  seats: 4
+  execution: {type: Uniform, min: 50ms, max: 500ms}
+`
+
+func TestRunIsDeterministic(t *testing.T) {
+	s, err := ParseScenario([]byte(scenario))
+	if err != nil {
+		t.Fatalf("failed to parse scenario: %v", err)
+	}
+
+	first, err := Run(s)
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	second, err := Run(s)
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the same report for the same seed\nfirst:  %+v\nsecond: %+v", first, second)
+	}
+
+	s.Seed = 2
+	third, err := Run(s)
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	if reflect.DeepEqual(first.Flows, third.Flows) {
+		t.Errorf("expected a different workload for a different seed")
+	}
+}
+
+func TestRunProtectsTheLightFlows(t *testing.T) {
+	s, err := ParseScenario([]byte(scenario))
+	if err != nil {
+		t.Fatalf("failed to parse scenario: %v", err)
+	}
+	report, err := Run(s)
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+
+	flows := map[string]FlowReport{}
+	for _, flow := range report.Flows {
+		flows[flow.Name] = flow
+		if flow.Arrived != flow.Executed+sum(flow.Rejected) {
+			t.Errorf("[%s]: expected every request to be executed or rejected, but got: %+v", flow.Name, flow)
+		}
+	}
+
+	// the elephant asks for twice the seats there are, the other
+	// flows ask for about their fair share, or less.
+	if elephant := flows["elephant"]; elephant.RejectionRate < 0.3 {
+		t.Errorf("expected the elephant to be rejected, but got: %+v", elephant)
+	}
+	for _, name := range []string{"mouse", "wide"} {
+		if flow := flows[name]; flow.RejectionRate != 0 {
+			t.Errorf("expected %s not to be rejected, but got: %+v", name, flow)
+		}
+	}
+	if mouse := flows["mouse"]; mouse.QueueWait.P99 > time.Second {
+		t.Errorf("expected the mouse to be served promptly, but got: %+v", mouse)
+	}
+	if report.Fairness < 0.9 {
+		t.Errorf("expected a fairness index close to 1, but got: %f", report.Fairness)
+	}
+}
+
+func TestParseScenarioErrorsNameTheField(t *testing.T) {
+	tests := []struct {
+		replace [2]string
+		want    string
+	}{
+		{replace: [2]string{"duration: 30s", "duration: 0s"}, want: "duration"},
+		{replace: [2]string{"handSize: 6", "handSize: 65"}, want: "queueSet.handSize"},
+		{replace: [2]string{"rate: 10", "rate: -1"}, want: "flows[1].rate"},
+		{replace: [2]string{"seats: 4", "seats: 11"}, want: "flows[2].seats"},
+		{replace: [2]string{"type: Uniform", "type: Normal"}, want: "flows[2].execution.type"},
+	}
+	for _, test := range tests {
+		_, err := ParseScenario([]byte(strings.Replace(scenario, test.replace[0], test.replace[1], 1)))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("expected an error naming %q, but got: %v", test.want, err)
+		}
+	}
+}
+
+func sum(counts map[fairqueuing.RejectReason]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
@@ -0,0 +1,180 @@
+package simulator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tkashem/apf/pkg/config"
+	"github.com/tkashem/apf/pkg/fairqueuing"
+	apfhttp "github.com/tkashem/apf/pkg/handler/http"
+)
+
+// Record is a request of a trace, a trace is written as JSON lines, one
+// record per line, for example:
+//
+//	{"id":"a","arrival":"1.5s","flow":["system:serviceaccount:ns:sa"],"seats":1,"duration":"120ms"}
+type Record struct {
+	// ID identifies the request in the results, it defaults to the
+	// line number of the record.
+	ID string `json:"id,omitempty"`
+
+	// Arrival is the time the request arrived, relative to the
+	// start of the trace.
+	Arrival config.Duration `json:"arrival"`
+
+	// Flow holds the flow distinguishers of the request, the flow ID
+	// is their hash, as computed by the http handler.
+	Flow []string `json:"flow"`
+
+	// Seats is the number of seats the request occupies, and
+	// Duration the time it actually took to execute.
+	Seats    uint32          `json:"seats"`
+	Duration config.Duration `json:"duration"`
+
+	// Estimate is the execution time the queueset is told the request
+	// takes, it defaults to Duration.
+	Estimate config.Duration `json:"estimate,omitempty"`
+
+	// Timeout, if positive, is the maximum time the request may wait
+	// in queue, it overrides the queue wait timeout of the queueset.
+	Timeout config.Duration `json:"timeout,omitempty"`
+}
+
+func (r *Record) flowID() fairqueuing.FlowIDType {
+	flow := apfhttp.ComputeFlow(nil, func(*http.Request) []string { return r.Flow })
+	return fairqueuing.FlowIDType(flow.Hash)
+}
+
+func (r *Record) estimate() time.Duration {
+	if r.Estimate.Duration > 0 {
+		return r.Estimate.Duration
+	}
+	return r.Duration.Duration
+}
+
+// Result tells what happened to a request of a trace when it was
+// replayed, the results are written as JSON lines, in the order of
+// the records.
+type Result struct {
+	ID string `json:"id"`
+
+	// Decision is either execute or reject, Reason tells why the
+	// request was rejected.
+	Decision string                   `json:"decision"`
+	Reason   fairqueuing.RejectReason `json:"reason,omitempty"`
+
+	// Queue is the ID of the queue the request was assigned to, it is
+	// not set if the request was rejected before a queue was selected.
+	Queue *uint32 `json:"queue,omitempty"`
+
+	// Arrival is the time the request arrived, and Wait the time it
+	// waited for a decision.
+	Arrival config.Duration `json:"arrival"`
+	Wait    config.Duration `json:"wait"`
+
+	// StartR and FinishR are the virtual times, in seat-seconds, the
+	// request was expected to start and finish executing when it was
+	// enqueued.
+	StartR  float64 `json:"startR"`
+	FinishR float64 `json:"finishR"`
+
+	// Code is the status code of the response, it is only set when
+	// the trace is replayed through the http handler.
+	Code int `json:"code,omitempty"`
+}
+
+const (
+	DecisionExecute = "execute"
+	DecisionReject  = "reject"
+)
+
+// ReadTrace reads the records of a trace, one per line, blank lines
+// are skipped and unknown fields are rejected.
+func ReadTrace(r io.Reader) ([]Record, error) {
+	var trace []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		record := Record{}
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(record.ID) == 0 {
+			record.ID = strconv.Itoa(line)
+		}
+		trace = append(trace, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+// ReadTraceFile reads the trace in the given file
+func ReadTraceFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	trace, err := ReadTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return trace, nil
+}
+
+// WriteResults writes the results, one per line
+func WriteResults(w io.Writer, results []Result) error {
+	encoder := json.NewEncoder(w)
+	for i := range results {
+		if err := encoder.Encode(&results[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTrace returns an error for each record that the queueset
+// can not take.
+func validateTrace(qs *QueueSet, trace []Record) error {
+	var errs []error
+	add := func(i int, field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("record %q: %s: %s", trace[i].ID, field, fmt.Sprintf(format, args...)))
+	}
+
+	for i, r := range trace {
+		if r.Arrival.Duration < 0 {
+			add(i, "arrival", "must not be negative")
+		}
+		if r.Seats < 1 || r.Seats > qs.TotalSeats {
+			add(i, "seats", "must be in the range [1, %d]", qs.TotalSeats)
+		}
+		if r.Duration.Duration < 0 {
+			add(i, "duration", "must not be negative")
+		}
+		if r.Estimate.Duration < 0 {
+			add(i, "estimate", "must not be negative")
+		}
+		if r.Timeout.Duration < 0 {
+			add(i, "timeout", "must not be negative")
+		}
+	}
+	return errors.Join(errs...)
+}